@@ -1,28 +1,67 @@
 package app
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	stderrors "errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"vpn/app/server"
 	"vpn/app/tun"
 
-	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/core"
-	"github.com/xtls/xray-core/features"
 
 	"github.com/xtls/xray-core/common/platform"
 	"github.com/xtls/xray-core/common/session"
+	"google.golang.org/protobuf/proto"
 )
 
-var instance *core.Instance
+var (
+	// primary is the instance managed by Run, Reload and Stop, and the one
+	// the control server reports on.
+	primary *handle
+	control *server.Server
+	mutex   sync.Mutex
+)
 
 type Config struct {
 	FilesDir string `json:"filesDir"`
 	CacheDir string `json:"cacheDir"`
 	TempDir  string `json:"tempDir"`
+	// Xray is the Xray JSON config, inline. XrayProtobuf is a serialized
+	// core.Config, base64 in JSON; its tun section is taken from Tun. When
+	// both are empty the config is read from ConfigFile, TempDir/config.json
+	// by default, in the format given by its extension: JSON, YAML, TOML or
+	// protobuf. ConfigFiles, if set, instead lists config fragments in the
+	// text formats that are merged in order, see loadConfigFiles. Tun, if
+	// set, replaces the tun section of the config; one of them is required.
+	Xray         json.RawMessage `json:"xray,omitempty"`
+	XrayProtobuf []byte          `json:"xrayProtobuf,omitempty"`
+	ConfigFile   string          `json:"configFile,omitempty"`
+	ConfigFiles  []string        `json:"configFiles,omitempty"`
+	Tun          *TunConfig      `json:"tun,omitempty"`
+
+	HappyEyeballs *HappyEyeballsConfig `json:"happyEyeballs,omitempty"`
+	BootstrapDNS  *BootstrapDNSConfig  `json:"bootstrapDNS,omitempty"`
+	// InterfaceCacheTTL is how many seconds the default interface name is
+	// cached, 5 by default. Zero caches it until the next network change,
+	// a negative value asks the platform on every dial.
+	InterfaceCacheTTL *int `json:"interfaceCacheTTL,omitempty"`
+}
+
+// BootstrapDNSConfig lists the servers resolving domains outside of Xray,
+// for example the addresses of proxy servers. Servers are "ip", "ip:port"
+// or URLs with the scheme udp, tcp, tls or https, and are tried in order.
+// Answers are cached for at most CacheTTL seconds, 30 by default.
+type BootstrapDNSConfig struct {
+	Servers  []string `json:"servers"`
+	CacheTTL int      `json:"cacheTTL"`
 }
 
 type TunSniffingConfig struct {
@@ -33,57 +72,293 @@ type TunSniffingConfig struct {
 	RouteOnly                      bool     `json:"routeOnly"`
 }
 
+type TunDNSHijackConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Servers    []string `json:"servers"`
+	NonIPQuery string   `json:"nonIPQuery"`
+}
+
+type TunBufferSizeRange struct {
+	Min     int `json:"min"`
+	Default int `json:"default"`
+	Max     int `json:"max"`
+}
+
+// TunStackConfig tunes the gVisor stack. Fields left out keep the values of
+// tun.DefaultStackConfig.
+type TunStackConfig struct {
+	TTL                      *uint8              `json:"ttl"`
+	ICMPBurst                *int                `json:"icmpBurst"`
+	ICMPLimit                *float64            `json:"icmpLimit"`
+	TCPSendBufferSize        *TunBufferSizeRange `json:"tcpSendBufferSize"`
+	TCPReceiveBufferSize     *TunBufferSizeRange `json:"tcpReceiveBufferSize"`
+	TCPCongestionControl     *string             `json:"tcpCongestionControl"`
+	TCPDelay                 *bool               `json:"tcpDelay"`
+	TCPModerateReceiveBuffer *bool               `json:"tcpModerateReceiveBuffer"`
+	TCPSACK                  *bool               `json:"tcpSACK"`
+	TCPRecovery              *string             `json:"tcpRecovery"`
+}
+
 type TunConfig struct {
-	Tag      string            `json:"tag"`
-	Fd       int               `json:"fd"`
-	MTU      int               `json:"mtu"`
-	Sniffing TunSniffingConfig `json:"sniffing"`
+	Tag       string             `json:"tag"`
+	Fd        int                `json:"fd"`
+	MTU       int                `json:"mtu"`
+	CloseFd   bool               `json:"closeFd"`
+	ICMP      string             `json:"icmp"`
+	Sniffing  TunSniffingConfig  `json:"sniffing"`
+	DNSHijack TunDNSHijackConfig `json:"dnsHijack"`
+	Stack     TunStackConfig     `json:"stack"`
 }
 
+// Run starts the core with config. It fails with CodeAlreadyRunning while an
+// instance is running. Errors carry one of the exported codes, see Code, and
+// are kept for LastError.
 func Run(config []byte) (err error) {
-	cfg := Config{}
-	err = json.Unmarshal(config, &cfg)
+	defer func() { setLastError(err) }()
+	cfg, err := parseConfig(config)
 	if err != nil {
 		return err
 	}
-	os.Setenv(platform.AssetLocation, filepath.Join(cfg.FilesDir, "asset"))
-	return run(cfg)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if primary != nil {
+		return newError(CodeAlreadyRunning, fmt.Errorf("already running"))
+	}
+	h := &handle{config: cfg}
+	if err := h.start(); err != nil {
+		return err
+	}
+	if err := startControl(cfg); err != nil {
+		h.stop()
+		return err
+	}
+	primary = h
+	return nil
 }
 
-func run(config Config) (err error) {
-	data, err := os.ReadFile(filepath.Join(config.TempDir, "config.json"))
+func Reload(config []byte) (err error) {
+	defer func() { setLastError(err) }()
+	cfg, err := parseConfig(config)
 	if err != nil {
 		return err
 	}
-	cfg, err := core.LoadConfig("json", bytes.NewReader(data))
+	mutex.Lock()
+	defer mutex.Unlock()
+	if primary == nil {
+		return newError(CodeNotRunning, fmt.Errorf("not running"))
+	}
+	return primary.reload(cfg)
+}
+
+func Stop() (err error) {
+	defer func() { setLastError(err) }()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if control != nil {
+		if err := control.Close(); err != nil {
+			errors.LogWarningInner(context.Background(), err, "failed to close control server")
+		}
+		control = nil
+	}
+	if primary == nil {
+		return nil
+	}
+	err = primary.stop()
+	primary = nil
+	return err
+}
+
+func parseConfig(config []byte) (cfg Config, err error) {
+	err = json.Unmarshal(config, &cfg)
 	if err != nil {
-		return err
+		return cfg, newError(CodeConfigInvalid, err)
 	}
-	instance, err = core.New(cfg)
+	os.Setenv(platform.AssetLocation, filepath.Join(cfg.FilesDir, "asset"))
+	return cfg, nil
+}
+
+// startControl starts the control server once, it is kept across reloads.
+func startControl(config Config) error {
+	if control != nil {
+		return nil
+	}
+	srv, err := server.New(context.Background(), &server.Config{
+		Path:     filepath.Join(config.FilesDir, "vpn.sock"),
+		Handlers: controlHandlers(),
+		Streams:  controlStreams(),
+	})
 	if err != nil {
-		return err
+		return newError(CodeSocketBind, err)
+	}
+	if err := srv.Start(); err != nil {
+		srv.Close()
+		return newError(CodeSocketBind, err)
 	}
-	instance.AddFeature(common.Must2(core.CreateObject(instance, &server.Config{
-		Path: filepath.Join(config.FilesDir, "vpn.sock"),
-	})).(features.Feature))
-	temp := &struct {
-		Tun TunConfig `json:"tun"`
-	}{}
-	err = json.Unmarshal(data, temp)
+	control = srv
+	return nil
+}
+
+// currentTun returns the tun of the instance managed by Run.
+func currentTun() *tun.Tun {
+	if primary == nil {
+		return nil
+	}
+	return primary.tun()
+}
+
+// build creates an instance and its tun from a parsed config. cfg is not
+// modified, so it can be built from again.
+func build(cfg *core.Config, tunCfg TunConfig) (*core.Instance, *tun.Tun, error) {
+	servers, err := parseDNSServers(tunCfg.DNSHijack.Servers)
 	if err != nil {
-		return err
+		return nil, nil, newError(CodeConfigInvalid, err)
 	}
-	instance.AddFeature(common.Must2(core.CreateObject(instance, &tun.Config{
-		Tag: temp.Tun.Tag,
-		Fd:  temp.Tun.Fd,
-		MTU: temp.Tun.MTU,
+	v, err := core.New(proto.Clone(cfg).(*core.Config))
+	if err != nil {
+		return nil, nil, newError(CodeCoreInit, err)
+	}
+	obj, err := core.CreateObject(v, &tun.Config{
+		Tag:     tunCfg.Tag,
+		Fd:      tunCfg.Fd,
+		MTU:     tunCfg.MTU,
+		CloseFd: tunCfg.CloseFd,
+		ICMP:    tunCfg.ICMP,
 		Sniffing: session.SniffingRequest{
-			Enabled:                        temp.Tun.Sniffing.Enabled,
-			MetadataOnly:                   temp.Tun.Sniffing.MetadataOnly,
-			RouteOnly:                      temp.Tun.Sniffing.RouteOnly,
-			OverrideDestinationForProtocol: temp.Tun.Sniffing.OverrideDestinationForProtocol,
-			ExcludeForDomain:               temp.Tun.Sniffing.ExcludeForDomain,
+			Enabled:                        tunCfg.Sniffing.Enabled,
+			MetadataOnly:                   tunCfg.Sniffing.MetadataOnly,
+			RouteOnly:                      tunCfg.Sniffing.RouteOnly,
+			OverrideDestinationForProtocol: tunCfg.Sniffing.OverrideDestinationForProtocol,
+			ExcludeForDomain:               tunCfg.Sniffing.ExcludeForDomain,
+		},
+		DNSHijack: tun.DNSHijackConfig{
+			Enabled:    tunCfg.DNSHijack.Enabled,
+			Servers:    servers,
+			NonIPQuery: tunCfg.DNSHijack.NonIPQuery,
 		},
-	})).(features.Feature))
-	return instance.Start()
+		Stack: tunCfg.Stack.build(),
+	})
+	if err != nil {
+		v.Close()
+		return nil, nil, newError(CodeConfigInvalid, err)
+	}
+	return v, obj.(*tun.Tun), nil
+}
+
+func loadConfig(config Config) (*core.Config, TunConfig, error) {
+	if len(config.XrayProtobuf) > 0 {
+		return loadProtobufConfig(config, config.XrayProtobuf)
+	}
+	data, format := []byte(config.Xray), "json"
+	if len(data) == 0 && len(config.ConfigFiles) > 0 {
+		cfg, tunCfg, err := loadConfigFiles(config.ConfigFiles)
+		if err != nil {
+			return nil, TunConfig{}, err
+		}
+		return withTun(config, cfg, tunCfg)
+	}
+	if len(data) == 0 {
+		path := config.ConfigFile
+		if path == "" {
+			path = filepath.Join(config.TempDir, "config.json")
+		}
+		var err error
+		data, err = os.ReadFile(path)
+		if stderrors.Is(err, os.ErrNotExist) {
+			return nil, TunConfig{}, newError(CodeConfigNotFound, err)
+		} else if err != nil {
+			return nil, TunConfig{}, err
+		}
+		format = configFormat(path)
+		if format == "protobuf" {
+			return loadProtobufConfig(config, data)
+		}
+	}
+	c, tunCfg, err := decodeConfig(format, data)
+	if err != nil {
+		return nil, TunConfig{}, newError(CodeConfigInvalid, err)
+	}
+	cfg, err := c.Build()
+	if err != nil {
+		return nil, TunConfig{}, newError(CodeConfigInvalid, err)
+	}
+	return withTun(config, cfg, tunCfg)
+}
+
+// withTun pairs cfg with config.Tun, or with tunCfg read from the config
+// when that is not set. One of them is required.
+func withTun(config Config, cfg *core.Config, tunCfg *TunConfig) (*core.Config, TunConfig, error) {
+	if config.Tun != nil {
+		tunCfg = config.Tun
+	}
+	if tunCfg == nil {
+		return nil, TunConfig{}, newError(CodeConfigInvalid, fmt.Errorf("tun config is required"))
+	}
+	return cfg, *tunCfg, nil
+}
+
+func loadProtobufConfig(config Config, data []byte) (*core.Config, TunConfig, error) {
+	if config.Tun == nil {
+		return nil, TunConfig{}, newError(CodeConfigInvalid, fmt.Errorf("tun config is required with protobuf config"))
+	}
+	cfg, err := LoadConfig("protobuf", data)
+	if err != nil {
+		return nil, TunConfig{}, err
+	}
+	return cfg, *config.Tun, nil
+}
+
+func (c *TunStackConfig) build() tun.StackConfig {
+	cfg := tun.DefaultStackConfig()
+	if c.TTL != nil {
+		cfg.TTL = *c.TTL
+	}
+	if c.ICMPBurst != nil {
+		cfg.ICMPBurst = *c.ICMPBurst
+	}
+	if c.ICMPLimit != nil {
+		cfg.ICMPLimit = *c.ICMPLimit
+	}
+	if c.TCPSendBufferSize != nil {
+		cfg.TCPSendBufferSize = tun.BufferSizeRange(*c.TCPSendBufferSize)
+	}
+	if c.TCPReceiveBufferSize != nil {
+		cfg.TCPReceiveBufferSize = tun.BufferSizeRange(*c.TCPReceiveBufferSize)
+	}
+	if c.TCPCongestionControl != nil {
+		cfg.TCPCongestionControl = *c.TCPCongestionControl
+	}
+	if c.TCPDelay != nil {
+		cfg.TCPDelay = *c.TCPDelay
+	}
+	if c.TCPModerateReceiveBuffer != nil {
+		cfg.TCPModerateReceiveBuffer = *c.TCPModerateReceiveBuffer
+	}
+	if c.TCPSACK != nil {
+		cfg.TCPSACK = *c.TCPSACK
+	}
+	if c.TCPRecovery != nil {
+		cfg.TCPRecovery = *c.TCPRecovery
+	}
+	return cfg
+}
+
+// parseDNSServers parses "ip" and "ip:port" entries, the port defaulting to 53.
+func parseDNSServers(servers []string) ([]net.Destination, error) {
+	dests := make([]net.Destination, 0, len(servers))
+	for _, server := range servers {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), "53"
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns hijack server: %s", server)
+		}
+		p, err := net.PortFromString(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns hijack server: %s", server)
+		}
+		dests = append(dests, net.UDPDestination(net.IPAddress(ip), p))
+	}
+	return dests, nil
 }
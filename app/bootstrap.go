@@ -0,0 +1,421 @@
+//go:build linux
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// bootstrapTimeout bounds a single exchange with one bootstrap server.
+const bootstrapTimeout = 5 * time.Second
+
+const defaultBootstrapCacheTTL = 30 * time.Second
+
+type bootstrapServer struct {
+	network    string
+	address    string
+	serverName string
+	url        string
+	client     *http.Client
+}
+
+// bootstrapResolver answers the queries of net.DefaultResolver from an
+// explicit server list, trying the servers in order and caching answers for
+// a short while. All sockets are bound to the default device.
+type bootstrapResolver struct {
+	servers []*bootstrapServer
+	ttl     time.Duration
+
+	mutex sync.Mutex
+	cache map[string]bootstrapCacheEntry
+}
+
+type bootstrapCacheEntry struct {
+	msg     []byte
+	expires time.Time
+}
+
+// newBootstrapResolver returns nil if config lists no servers, in which
+// case the servers of the system configuration are used.
+func newBootstrapResolver(config *BootstrapDNSConfig) (*bootstrapResolver, error) {
+	if config == nil || len(config.Servers) == 0 {
+		return nil, nil
+	}
+	r := &bootstrapResolver{
+		ttl:   defaultBootstrapCacheTTL,
+		cache: make(map[string]bootstrapCacheEntry),
+	}
+	if config.CacheTTL != 0 {
+		r.ttl = time.Duration(config.CacheTTL) * time.Second
+	}
+	for _, s := range config.Servers {
+		server, err := parseBootstrapServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r, nil
+}
+
+// parseBootstrapServer parses "ip", "ip:port" or a URL with the scheme udp,
+// tcp, tls or https. The host must be an IP address; the TLS server name
+// defaults to it and can be set with the "sni" query parameter.
+func parseBootstrapServer(s string) (*bootstrapServer, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap dns server: %s", s)
+	}
+	if net.ParseIP(u.Hostname()) == nil {
+		return nil, fmt.Errorf("bootstrap dns server must be an ip address: %s", s)
+	}
+	port := u.Port()
+	server := &bootstrapServer{network: u.Scheme}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if port == "" {
+			port = "53"
+		}
+	case "tls":
+		if port == "" {
+			port = "853"
+		}
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	default:
+		return nil, fmt.Errorf("unknown bootstrap dns server scheme: %s", u.Scheme)
+	}
+	server.address = net.JoinHostPort(u.Hostname(), port)
+	query := u.Query()
+	server.serverName = query.Get("sni")
+	if server.serverName == "" {
+		server.serverName = u.Hostname()
+	}
+	if u.Scheme == "https" {
+		query.Del("sni")
+		u.RawQuery = query.Encode()
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		server.url = u.String()
+		server.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext:         bootstrapDialer().DialContext,
+				TLSClientConfig:     &tls.Config{ServerName: server.serverName},
+				ForceAttemptHTTP2:   true,
+				IdleConnTimeout:     30 * time.Second,
+				TLSHandshakeTimeout: bootstrapTimeout,
+			},
+		}
+	}
+	return server, nil
+}
+
+func bootstrapDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: time.Second * 16,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return (&OHSystemDialer{}).BindToDefaultDevice(c)
+		},
+	}
+}
+
+// exchange answers query from the cache or from the first server giving a
+// usable answer. SERVFAIL and REFUSED answers move on to the next server but
+// are returned if no server does better.
+func (r *bootstrapResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	key, err := bootstrapCacheKey(query)
+	if err != nil {
+		return nil, err
+	}
+	if msg := r.cached(key, query); msg != nil {
+		return msg, nil
+	}
+	var last []byte
+	var lastErr error
+	for _, server := range r.servers {
+		msg, err := server.exchange(ctx, query)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if len(msg) < 12 || !bytes.Equal(msg[:2], query[:2]) {
+			lastErr = fmt.Errorf("invalid answer from %s", server.address)
+			continue
+		}
+		switch dnsmessage.RCode(msg[3] & 0x0f) {
+		case dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused:
+			last = msg
+			continue
+		}
+		r.store(key, msg)
+		return msg, nil
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, lastErr
+}
+
+func bootstrapCacheKey(query []byte) (string, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return "", err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name.String()), q.Type, q.Class), nil
+}
+
+func (r *bootstrapResolver) cached(key string, query []byte) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil
+	}
+	msg := bytes.Clone(entry.msg)
+	copy(msg[:2], query[:2])
+	return msg
+}
+
+// store caches msg for the cache TTL, or for less if its records expire
+// sooner.
+func (r *bootstrapResolver) store(key string, msg []byte) {
+	ttl := r.ttl
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		ttl = min(ttl, time.Duration(h.TTL)*time.Second)
+		if err := p.SkipAnswer(); err != nil {
+			break
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for k, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = bootstrapCacheEntry{msg: bytes.Clone(msg), expires: now.Add(ttl)}
+}
+
+func (s *bootstrapServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+	defer cancel()
+	switch s.network {
+	case "udp":
+		msg, err := s.exchangePacket(ctx, query)
+		if err == nil && msg[2]&0x02 != 0 {
+			// Truncated, retry over TCP.
+			return s.exchangeStream(ctx, "tcp", query)
+		}
+		return msg, err
+	case "https":
+		return s.exchangeHTTPS(ctx, query)
+	default:
+		return s.exchangeStream(ctx, s.network, query)
+	}
+}
+
+func (s *bootstrapServer) exchangePacket(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := bootstrapDialer().DialContext(ctx, "udp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 65535)
+	for {
+		n, err := conn.Read(msg)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 12 && bytes.Equal(msg[:2], query[:2]) {
+			return msg[:n], nil
+		}
+	}
+}
+
+func (s *bootstrapServer) exchangeStream(ctx context.Context, network string, query []byte) ([]byte, error) {
+	conn, err := bootstrapDialer().DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tls" {
+		conn = tls.Client(conn, &tls.Config{ServerName: s.serverName})
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(frame, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// watchContext applies the deadline of ctx to conn and interrupts pending
+// I/O on conn once ctx is cancelled. The returned func stops watching.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+func (s *bootstrapServer) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server %s returned %s", s.address, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// bootstrapConn is handed to the Go resolver in place of a connection to a
+// system DNS server. It is not a net.PacketConn, so the resolver frames
+// queries as over TCP; each one is answered through the bootstrap resolver.
+type bootstrapConn struct {
+	ctx      context.Context
+	resolver *bootstrapResolver
+
+	mutex    sync.Mutex
+	deadline time.Time
+	pending  []byte
+	answers  bytes.Buffer
+}
+
+func (c *bootstrapConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.pending = append(c.pending, b...)
+	deadline := c.deadline
+	c.mutex.Unlock()
+	for {
+		c.mutex.Lock()
+		if len(c.pending) < 2 || len(c.pending) < 2+int(binary.BigEndian.Uint16(c.pending)) {
+			c.mutex.Unlock()
+			return len(b), nil
+		}
+		n := 2 + int(binary.BigEndian.Uint16(c.pending))
+		query := bytes.Clone(c.pending[2:n])
+		c.pending = c.pending[n:]
+		c.mutex.Unlock()
+
+		ctx, cancel := c.queryContext(deadline)
+		msg, err := c.resolver.exchange(ctx, query)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		c.mutex.Lock()
+		c.answers.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg))))
+		c.answers.Write(msg)
+		c.mutex.Unlock()
+	}
+}
+
+// queryContext returns the context of a single query, bounded by the
+// deadline set on c if any.
+func (c *bootstrapConn) queryContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(c.ctx)
+	}
+	return context.WithDeadline(c.ctx, deadline)
+}
+
+func (c *bootstrapConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.answers.Read(b)
+}
+
+func (c *bootstrapConn) Close() error {
+	return nil
+}
+
+func (c *bootstrapConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bootstrapConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bootstrapConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *bootstrapConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bootstrapConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
@@ -0,0 +1,250 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"vpn/app/ohos"
+	"vpn/app/server"
+	"vpn/app/tun"
+	"vpn/app/tun/capture"
+
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/stats"
+)
+
+type StatusResult struct {
+	Running bool  `json:"running"`
+	Uptime  int64 `json:"uptime"`
+}
+
+type StatsParams struct {
+	Pattern string `json:"pattern"`
+	Reset   bool   `json:"reset"`
+}
+
+type CloseConnectionParams struct {
+	ID uint64 `json:"id"`
+}
+
+// CaptureParams starts a packet capture of the tun to CacheDir/Name. A zero
+// MaxBytes defaults to DefaultCaptureMaxBytes, a zero MaxPackets means no
+// packet limit.
+type CaptureParams struct {
+	Name       string `json:"name"`
+	SnapLen    int    `json:"snapLen"`
+	MaxPackets int    `json:"maxPackets"`
+	MaxBytes   int64  `json:"maxBytes"`
+}
+
+const DefaultCaptureMaxBytes = 64 << 20
+
+type VersionResult struct {
+	Xray string `json:"xray"`
+	Go   string `json:"go"`
+}
+
+func controlHandlers() map[string]server.Handler {
+	return map[string]server.Handler{
+		"status":  handleStatus,
+		"stats":   handleStats,
+		"reload":  handleReload,
+		"stop":    handleStop,
+		"version": handleVersion,
+
+		"connections":     handleConnections,
+		"closeConnection": handleCloseConnection,
+
+		"startCapture": handleStartCapture,
+		"stopCapture":  handleStopCapture,
+		"capture":      handleCapture,
+	}
+}
+
+func controlStreams() map[string]server.Stream {
+	return map[string]server.Stream{
+		"logs": streamLogs,
+	}
+}
+
+func handleStatus(_ json.RawMessage) (any, func(), error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	result := &StatusResult{Running: primary != nil && primary.running()}
+	if result.Running {
+		result.Uptime = int64(time.Since(primary.startedAt) / time.Second)
+	}
+	return result, nil, nil
+}
+
+func handleStats(params json.RawMessage) (any, func(), error) {
+	p := &StatsParams{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, p); err != nil {
+			return nil, nil, err
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	result := make(map[string]int64)
+	visit := func(name string, c *atomic.Int64) {
+		if strings.Contains(name, p.Pattern) {
+			if p.Reset {
+				result[name] = c.Swap(0)
+			} else {
+				result[name] = c.Load()
+			}
+		}
+	}
+	visitDialerCounters(visit)
+	ohos.VisitCounters(visit)
+	if primary == nil || primary.instance == nil {
+		return result, nil, nil
+	}
+	manager, ok := primary.instance.GetFeature(stats.ManagerType()).(interface {
+		VisitCounters(func(string, stats.Counter) bool)
+	})
+	if !ok {
+		return result, nil, nil
+	}
+	manager.VisitCounters(func(name string, c stats.Counter) bool {
+		if strings.Contains(name, p.Pattern) {
+			if p.Reset {
+				result[name] = c.Set(0)
+			} else {
+				result[name] = c.Value()
+			}
+		}
+		return true
+	})
+	return result, nil, nil
+}
+
+// handleReload reloads with the Run config given as params, or with the
+// config of the running instance when params are empty.
+func handleReload(params json.RawMessage) (any, func(), error) {
+	if len(params) > 0 {
+		return nil, nil, Reload(params)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if primary == nil {
+		return nil, nil, newError(CodeNotRunning, fmt.Errorf("not running"))
+	}
+	return nil, nil, primary.reload(primary.config)
+}
+
+func handleStop(_ json.RawMessage) (any, func(), error) {
+	return nil, func() {
+		Stop()
+	}, nil
+}
+
+func handleConnections(_ json.RawMessage) (any, func(), error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if t := currentTun(); t != nil {
+		return t.Flows(), nil, nil
+	}
+	return []tun.Flow{}, nil, nil
+}
+
+func handleCloseConnection(params json.RawMessage) (any, func(), error) {
+	p := &CloseConnectionParams{}
+	if err := json.Unmarshal(params, p); err != nil {
+		return nil, nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if t := currentTun(); t == nil || !t.CloseFlow(p.ID) {
+		return nil, nil, fmt.Errorf("connection not found: %d", p.ID)
+	}
+	return nil, nil, nil
+}
+
+func handleStartCapture(params json.RawMessage) (any, func(), error) {
+	p := &CaptureParams{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, p); err != nil {
+			return nil, nil, err
+		}
+	}
+	name := filepath.Base(p.Name)
+	if p.Name == "" || name == "." || name == "/" {
+		name = "tun.pcap"
+	}
+	if p.MaxBytes == 0 {
+		p.MaxBytes = DefaultCaptureMaxBytes
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	t := currentTun()
+	if t == nil {
+		return nil, nil, fmt.Errorf("not running")
+	}
+	err := t.StartCapture(capture.Config{
+		Path:       filepath.Join(primary.config.CacheDir, name),
+		SnapLen:    p.SnapLen,
+		MaxPackets: p.MaxPackets,
+		MaxBytes:   p.MaxBytes,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	stats, _ := t.Capture()
+	return stats, nil, nil
+}
+
+func handleStopCapture(_ json.RawMessage) (any, func(), error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	t := currentTun()
+	if t == nil {
+		return nil, nil, fmt.Errorf("not running")
+	}
+	stats, err := t.StopCapture()
+	if err != nil {
+		return nil, nil, err
+	}
+	return stats, nil, nil
+}
+
+func handleCapture(_ json.RawMessage) (any, func(), error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if t := currentTun(); t != nil {
+		if stats, ok := t.Capture(); ok {
+			return stats, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func handleVersion(_ json.RawMessage) (any, func(), error) {
+	return &VersionResult{
+		Xray: core.Version(),
+		Go:   runtime.Version(),
+	}, nil, nil
+}
+
+func streamLogs(params json.RawMessage, send func(any) error) (func(), func(), error) {
+	p := &LogStreamParams{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, p); err != nil {
+			return nil, nil, err
+		}
+	}
+	level, err := parseSeverity(p.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	start, cancel := logs.Subscribe(level, func(entry LogEntry) error {
+		return send(entry)
+	})
+	return start, cancel, nil
+}
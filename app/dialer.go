@@ -4,6 +4,7 @@ package app
 
 import (
 	"context"
+	gonet "net"
 	"syscall"
 	"time"
 
@@ -18,22 +19,28 @@ var _ internet.SystemDialer = (*OHSystemDialer)(nil)
 
 type OHSystemDialer struct{}
 
-func (d *OHSystemDialer) Dial(ctx context.Context, src net.Address, dest net.Destination, _ *internet.SocketConfig) (net.Conn, error) {
+func (d *OHSystemDialer) Dial(ctx context.Context, src net.Address, dest net.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
 	errors.LogDebug(ctx, "dialing to "+dest.String())
 	switch dest.Network {
 	case net.Network_TCP:
-		goStdKeepAlive := time.Duration(0)
-		dialer := &net.Dialer{
-			Timeout:   time.Second * 16,
-			LocalAddr: d.ResolveSrcAddr(dest.Network, src),
-			KeepAlive: goStdKeepAlive,
-		}
-		dialer.Control = func(network, address string, c syscall.RawConn) error {
-			return d.BindToDefaultDevice(c)
+		if dest.Address.Family().IsDomain() {
+			ips, err := gonet.DefaultResolver.LookupIP(ctx, "ip", dest.Address.Domain())
+			if err != nil {
+				return nil, err
+			}
+			return happyEyeballsSettings.Load().dial(ctx, ips, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+				return d.dialTCP(ctx, src, net.TCPDestination(net.IPAddress(ip), dest.Port), sockopt)
+			})
 		}
-		return dialer.DialContext(ctx, dest.Network.SystemString(), dest.NetAddr())
+		return d.dialTCP(ctx, src, dest, sockopt)
 	case net.Network_UDP:
 		srcAddr := d.ResolveSrcAddr(net.Network_UDP, src)
+		if sockopt != nil && len(sockopt.BindAddress) > 0 && sockopt.BindPort > 0 {
+			srcAddr = &net.UDPAddr{
+				IP:   sockopt.BindAddress,
+				Port: int(sockopt.BindPort),
+			}
+		}
 		if srcAddr == nil {
 			srcAddr = &net.UDPAddr{
 				IP:   []byte{0, 0, 0, 0},
@@ -41,8 +48,10 @@ func (d *OHSystemDialer) Dial(ctx context.Context, src net.Address, dest net.Des
 			}
 		}
 		var lc net.ListenConfig
-		lc.Control = func(network, address string, c syscall.RawConn) error {
-			return d.BindToDefaultDevice(c)
+		var device string
+		lc.Control = func(network, address string, c syscall.RawConn) (err error) {
+			device, err = d.control(ctx, network, c, sockopt)
+			return err
 		}
 		packetConn, err := lc.ListenPacket(ctx, srcAddr.Network(), srcAddr.String())
 		if err != nil {
@@ -50,8 +59,12 @@ func (d *OHSystemDialer) Dial(ctx context.Context, src net.Address, dest net.Des
 		}
 		destAddr, err := net.ResolveUDPAddr("udp", dest.NetAddr())
 		if err != nil {
+			packetConn.Close()
 			return nil, err
 		}
+		if sockopt == nil || sockopt.Interface == "" {
+			boundConns.add(packetConn, device)
+		}
 		return &internet.PacketConnWrapper{
 			Conn: packetConn,
 			Dest: destAddr,
@@ -61,6 +74,35 @@ func (d *OHSystemDialer) Dial(ctx context.Context, src net.Address, dest net.Des
 	}
 }
 
+func (d *OHSystemDialer) dialTCP(ctx context.Context, src net.Address, dest net.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	keepAlive, keepAliveConfig, err := keepAlive(sockopt)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:         time.Second * 16,
+		LocalAddr:       d.ResolveSrcAddr(dest.Network, src),
+		KeepAlive:       keepAlive,
+		KeepAliveConfig: keepAliveConfig,
+	}
+	if sockopt != nil && sockopt.TcpMptcp {
+		dialer.SetMultipathTCP(true)
+	}
+	var device string
+	dialer.Control = func(network, address string, c syscall.RawConn) (err error) {
+		device, err = d.control(ctx, network, c, sockopt)
+		return err
+	}
+	conn, err := dialer.DialContext(ctx, dest.Network.SystemString(), dest.NetAddr())
+	if err != nil {
+		return nil, err
+	}
+	if sockopt == nil || sockopt.Interface == "" {
+		boundConns.add(conn, device)
+	}
+	return conn, nil
+}
+
 func (d *OHSystemDialer) DestIpAddress() net.IP {
 	return nil
 }
@@ -82,18 +124,40 @@ func (d *OHSystemDialer) ResolveSrcAddr(network net.Network, src net.Address) ne
 }
 
 func (d *OHSystemDialer) BindToDefaultDevice(conn syscall.RawConn) error {
+	_, err := d.bind(conn)
+	return err
+}
+
+// bind binds conn to the default interface and returns its name.
+func (d *OHSystemDialer) bind(conn syscall.RawConn) (string, error) {
+	return d.control(context.Background(), "", conn, nil)
+}
+
+// control binds conn to the interface set in sockopt, or else to the default
+// one, and applies the other socket options. Failing options are logged and
+// do not fail the dial, as with Xray's default system dialer.
+func (d *OHSystemDialer) control(ctx context.Context, network string, conn syscall.RawConn, sockopt *internet.SocketConfig) (string, error) {
+	var device string
 	var innerErr error
 	err := conn.Control(func(fd uintptr) {
-		if device, err := ohos.MustGetPlatformSupport().GetDefaultNetInterfaceName(); err != nil {
-			innerErr = err
-		} else {
-			innerErr = syscall.BindToDevice(int(fd), device)
+		if sockopt != nil && sockopt.Interface != "" {
+			device = sockopt.Interface
+		} else if device, innerErr = ohos.DefaultNetInterfaceName(); innerErr != nil {
+			return
+		}
+		if innerErr = syscall.BindToDevice(int(fd), device); innerErr != nil {
+			return
+		}
+		if sockopt != nil {
+			if err := applySocketOptions(network, int(fd), sockopt); err != nil {
+				errors.LogInfoInner(ctx, err, "failed to apply socket options")
+			}
 		}
 	})
 	if err == nil {
-		return innerErr
+		return device, innerErr
 	}
-	return err
+	return device, err
 }
 
 func init() {
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"errors"
+	"sync"
+)
+
+// Codes returned by Run, Reload, Stop and the instance functions. CodeInternal is returned for
+// failures outside the taxonomy.
+const (
+	CodeOK              int32 = 0
+	CodeConfigInvalid   int32 = 400
+	CodeConfigNotFound  int32 = 404
+	CodeAlreadyRunning  int32 = 409
+	CodeNotRunning      int32 = 412
+	CodeUnknownInstance int32 = 422
+	CodeInternal        int32 = 500
+	CodeCoreInit        int32 = 501
+	CodeTunStart        int32 = 502
+	CodeSocketBind      int32 = 503
+)
+
+// Error is an error with one of the exported codes.
+type Error struct {
+	Code int32
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(code int32, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Code returns the code of err, CodeOK for nil and CodeInternal for errors
+// without a code.
+func Code(err error) int32 {
+	if err == nil {
+		return CodeOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+var (
+	lastErrorMutex sync.Mutex
+	lastError      error
+)
+
+// LastError returns the error of the last Run, Reload, Stop or instance
+// call, nil if it succeeded.
+func LastError() error {
+	lastErrorMutex.Lock()
+	defer lastErrorMutex.Unlock()
+	return lastError
+}
+
+func setLastError(err error) error {
+	lastErrorMutex.Lock()
+	defer lastErrorMutex.Unlock()
+	lastError = err
+	return err
+}
@@ -0,0 +1,273 @@
+package app
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"vpn/app/ohos"
+	"vpn/app/tun"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/core"
+)
+
+// handle is a core instance together with the config it is built from. A
+// stopped handle has no instance and builds a new one when started again.
+// xray and tunConfig are the config as parsed when the instance was
+// started, and are what rebuild uses.
+type handle struct {
+	config    Config
+	xray      *core.Config
+	tunConfig TunConfig
+	instance  *core.Instance
+	startedAt time.Time
+}
+
+var (
+	handles    = make(map[int64]*handle)
+	nextHandle int64
+	// lastStarted is the handle whose settings are applied.
+	lastStarted *handle
+)
+
+// Create registers an instance built from config and returns its id. The
+// instance is only built and started by StartInstance. Instances are
+// independent of each other and of the one managed by Run, apart from the
+// process wide dialer and resolver settings, which follow the instance
+// started last.
+func Create(config []byte) (id int64, err error) {
+	defer func() { setLastError(err) }()
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	nextHandle++
+	handles[nextHandle] = &handle{config: cfg}
+	return nextHandle, nil
+}
+
+// StartInstance starts the instance id. It fails with CodeAlreadyRunning if
+// the instance is running.
+func StartInstance(id int64) (err error) {
+	defer func() { setLastError(err) }()
+	mutex.Lock()
+	defer mutex.Unlock()
+	h, err := lookupHandle(id)
+	if err != nil {
+		return err
+	}
+	if h.instance != nil {
+		return newError(CodeAlreadyRunning, fmt.Errorf("instance %d already running", id))
+	}
+	return h.start()
+}
+
+// StopInstance stops the instance id, it can be started again.
+func StopInstance(id int64) (err error) {
+	defer func() { setLastError(err) }()
+	mutex.Lock()
+	defer mutex.Unlock()
+	h, err := lookupHandle(id)
+	if err != nil {
+		return err
+	}
+	return h.stop()
+}
+
+// Destroy stops the instance id and forgets it.
+func Destroy(id int64) (err error) {
+	defer func() { setLastError(err) }()
+	mutex.Lock()
+	defer mutex.Unlock()
+	h, err := lookupHandle(id)
+	if err != nil {
+		return err
+	}
+	delete(handles, id)
+	return h.stop()
+}
+
+func lookupHandle(id int64) (*handle, error) {
+	h, ok := handles[id]
+	if !ok {
+		return nil, newError(CodeUnknownInstance, fmt.Errorf("unknown instance: %d", id))
+	}
+	return h, nil
+}
+
+func (h *handle) running() bool {
+	return h.instance != nil && h.instance.IsRunning()
+}
+
+func (h *handle) tun() *tun.Tun {
+	if h.instance == nil {
+		return nil
+	}
+	t, _ := h.instance.GetFeature((*tun.Tun)(nil)).(*tun.Tun)
+	return t
+}
+
+func (h *handle) start() error {
+	settings, err := newSettings(h.config)
+	if err != nil {
+		return err
+	}
+	cfg, tunCfg, err := loadConfig(h.config)
+	if err != nil {
+		return err
+	}
+	v, t, err := build(cfg, tunCfg)
+	if err != nil {
+		return err
+	}
+	if err := startInstance(v, t); err != nil {
+		v.Close()
+		return err
+	}
+	h.xray, h.tunConfig = cfg, tunCfg
+	h.instance = v
+	h.startedAt = time.Now()
+	lastStarted = h
+	settings.apply()
+	return nil
+}
+
+// reload replaces the running instance with one built from config.
+func (h *handle) reload(config Config) error {
+	if h.instance == nil {
+		return newError(CodeNotRunning, fmt.Errorf("not running"))
+	}
+	settings, err := newSettings(config)
+	if err != nil {
+		return err
+	}
+	cfg, tunCfg, err := loadConfig(config)
+	if err != nil {
+		return err
+	}
+	if err := h.replace(cfg, tunCfg); err != nil {
+		return err
+	}
+	h.config = config
+	h.xray, h.tunConfig = cfg, tunCfg
+	h.startedAt = time.Now()
+	lastStarted = h
+	settings.apply()
+	return nil
+}
+
+// rebuild replaces the running instance with a fresh one built from the
+// config it was started with, without reading the config again.
+func (h *handle) rebuild() error {
+	if h.instance == nil {
+		return newError(CodeNotRunning, fmt.Errorf("not running"))
+	}
+	return h.replace(h.xray, h.tunConfig)
+}
+
+// replace starts an instance built from cfg and tunCfg in place of the
+// running one. The gVisor stack and tun fd of the running instance are
+// handed over to the new one, so the tun device stays up, and new flows go
+// to the new instance once it has started. If it fails to start the stack
+// is handed back and the running instance is kept.
+func (h *handle) replace(cfg *core.Config, tunCfg TunConfig) error {
+	v, t, err := build(cfg, tunCfg)
+	if err != nil {
+		return err
+	}
+	prev := h.tun()
+	if prev != nil {
+		if err := t.Adopt(prev); err != nil {
+			v.Close()
+			return newError(CodeTunStart, err)
+		}
+	}
+	err = startInstance(v, t)
+	switched := false
+	if err == nil && prev != nil {
+		switched = true
+		if err = t.Switch(); err != nil {
+			err = newError(CodeTunStart, err)
+		}
+	}
+	if err != nil {
+		if prev != nil {
+			if err := prev.Adopt(t); err != nil {
+				errors.LogErrorInner(context.Background(), err, "failed to hand the tun back to the running instance")
+			} else if switched {
+				if err := prev.Switch(); err != nil {
+					errors.LogErrorInner(context.Background(), err, "failed to restore the tun handlers of the running instance")
+				}
+			}
+		}
+		v.Close()
+		return err
+	}
+	if err := h.instance.Close(); err != nil {
+		errors.LogWarningInner(context.Background(), err, "failed to close previous instance")
+	}
+	h.instance = v
+	return nil
+}
+
+func (h *handle) stop() error {
+	if h.instance == nil {
+		return nil
+	}
+	err := h.instance.Close()
+	h.instance = nil
+	return newError(CodeInternal, err)
+}
+
+func startInstance(v *core.Instance, t *tun.Tun) error {
+	v.AddFeature(t)
+	if err := v.Start(); err != nil {
+		var startErr *tun.StartError
+		if stderrors.As(err, &startErr) {
+			return newError(CodeTunStart, err)
+		}
+		return newError(CodeCoreInit, err)
+	}
+	return nil
+}
+
+// settings are the process wide dialer and resolver settings of a config.
+type settings struct {
+	happyEyeballs  *happyEyeballs
+	bootstrap      *bootstrapResolver
+	interfaceCache time.Duration
+}
+
+func newSettings(config Config) (*settings, error) {
+	h, err := newHappyEyeballs(config.HappyEyeballs)
+	if err != nil {
+		return nil, newError(CodeConfigInvalid, err)
+	}
+	r, err := newBootstrapResolver(config.BootstrapDNS)
+	if err != nil {
+		return nil, newError(CodeConfigInvalid, err)
+	}
+	ttl := ohos.DefaultNetInterfaceCacheTTL
+	if config.InterfaceCacheTTL != nil {
+		ttl = time.Duration(*config.InterfaceCacheTTL) * time.Second
+	}
+	return &settings{happyEyeballs: h, bootstrap: r, interfaceCache: ttl}, nil
+}
+
+func (s *settings) apply() {
+	happyEyeballsSettings.Store(s.happyEyeballs)
+	bootstrap.Store(s.bootstrap)
+	ohos.SetDefaultNetInterfaceCacheTTL(s.interfaceCache)
+}
+
+func allHandles() []*handle {
+	all := make([]*handle, 0, len(handles))
+	for _, h := range handles {
+		all = append(all, h)
+	}
+	return all
+}
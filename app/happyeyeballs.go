@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+)
+
+// HappyEyeballsConfig tunes the RFC 8305 racing of TCP dials to domains.
+type HappyEyeballsConfig struct {
+	// Prefer is the family tried first, "ipv6" (default) or "ipv4".
+	Prefer string `json:"prefer"`
+	// Delay is the time in milliseconds before the next address is tried
+	// while earlier attempts are pending, 250 by default. A negative delay
+	// only moves on when an attempt fails.
+	Delay int `json:"delay"`
+}
+
+const defaultHappyEyeballsDelay = 250 * time.Millisecond
+
+type happyEyeballs struct {
+	preferIPv4 bool
+	delay      time.Duration
+}
+
+var (
+	happyEyeballsSettings atomic.Pointer[happyEyeballs]
+
+	// Number of raced dials won by each family.
+	happyEyeballsWonIPv4 atomic.Int64
+	happyEyeballsWonIPv6 atomic.Int64
+)
+
+func init() {
+	happyEyeballsSettings.Store(&happyEyeballs{delay: defaultHappyEyeballsDelay})
+}
+
+func newHappyEyeballs(config *HappyEyeballsConfig) (*happyEyeballs, error) {
+	h := &happyEyeballs{delay: defaultHappyEyeballsDelay}
+	if config == nil {
+		return h, nil
+	}
+	switch config.Prefer {
+	case "", "ipv6":
+	case "ipv4":
+		h.preferIPv4 = true
+	default:
+		return nil, fmt.Errorf("unknown happy eyeballs preference: %s", config.Prefer)
+	}
+	switch {
+	case config.Delay < 0:
+		h.delay = -1
+	case config.Delay > 0:
+		h.delay = time.Duration(config.Delay) * time.Millisecond
+	}
+	return h, nil
+}
+
+// sort interleaves the address families, starting with the preferred one.
+func (h *happyEyeballs) sort(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == h.preferIPv4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	if len(first) == 0 {
+		first, second = second, nil
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// dial starts a connection attempt to each of ips in turn, the next one
+// after the delay or as soon as the previous attempt fails, and returns the
+// first to succeed. The other attempts are cancelled.
+func (h *happyEyeballs) dial(ctx context.Context, ips []net.IP, dial func(context.Context, net.IP) (net.Conn, error)) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address to dial")
+	}
+	ips = h.sort(ips)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, ip)
+			results <- dialResult{conn: conn, ip: ip, err: err}
+		}()
+	}
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	startNext := func() {
+		if next < len(ips) {
+			start()
+			if h.delay >= 0 {
+				timer.Reset(h.delay)
+			}
+		}
+	}
+	startNext()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startNext()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				startNext()
+				continue
+			}
+			if r.ip.To4() != nil {
+				happyEyeballsWonIPv4.Add(1)
+			} else {
+				happyEyeballsWonIPv6.Add(1)
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(pending)
+			return r.conn, nil
+		}
+	}
+	return nil, firstErr
+}
+
+// visitDialerCounters calls fn with the dialer statistics, named like the
+// Xray stats counters.
+func visitDialerCounters(fn func(name string, c *atomic.Int64)) {
+	fn("dialer>>>happyEyeballs>>>ipv4>>>won", &happyEyeballsWonIPv4)
+	fn("dialer>>>happyEyeballs>>>ipv6>>>won", &happyEyeballsWonIPv6)
+}
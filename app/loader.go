@@ -1,24 +1,220 @@
 package app
 
 import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/ghodss/yaml"
+	"github.com/pelletier/go-toml"
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+	json_reader "github.com/xtls/xray-core/infra/conf/json"
 	"github.com/xtls/xray-core/infra/conf/serial"
 )
 
 func init() {
-	common.Must(core.RegisterConfigLoader(&core.ConfigFormat{
-		Name:      "JSON",
-		Extension: []string{"json"},
-		Loader: func(input any) (*core.Config, error) {
-			switch v := input.(type) {
-			case io.Reader:
-				return serial.LoadJSONConfig(v)
-			default:
-				panic("unavailable")
+	formats := []*core.ConfigFormat{
+		{Name: "JSON", Extension: []string{"json", "jsonc"}, Loader: readerLoader(serial.LoadJSONConfig)},
+		{Name: "YAML", Extension: []string{"yaml", "yml"}, Loader: readerLoader(serial.LoadYAMLConfig)},
+		{Name: "TOML", Extension: []string{"toml"}, Loader: readerLoader(serial.LoadTOMLConfig)},
+	}
+	for _, f := range formats {
+		common.Must(core.RegisterConfigLoader(f))
+	}
+}
+
+// readerLoader returns a core.ConfigLoader for load. core.LoadConfig only
+// hands io.Reader inputs to loaders, anything else is an error; LoadConfig
+// also takes []byte and file paths.
+func readerLoader(load func(io.Reader) (*core.Config, error)) core.ConfigLoader {
+	return func(input any) (*core.Config, error) {
+		r, ok := input.(io.Reader)
+		if !ok {
+			return nil, fmt.Errorf("unsupported config input: %T", input)
+		}
+		return load(r)
+	}
+}
+
+// LoadConfig reads an Xray config in format, "json", "yaml", "toml" or
+// "protobuf", from input: an io.Reader, the config as []byte or the path of
+// a config file. An empty format is taken from the extension of the path,
+// and is JSON for the other inputs. A tun section in the config is ignored.
+func LoadConfig(format string, input any) (*core.Config, error) {
+	switch v := input.(type) {
+	case io.Reader:
+	case []byte:
+		input = bytes.NewReader(v)
+	case string:
+		if format == "" {
+			format = configFormat(v)
+		}
+		f, err := os.Open(v)
+		if stderrors.Is(err, os.ErrNotExist) {
+			return nil, newError(CodeConfigNotFound, err)
+		} else if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		input = f
+	default:
+		return nil, newError(CodeConfigInvalid, fmt.Errorf("unsupported config input: %T", input))
+	}
+	if format == "" {
+		format = "json"
+	}
+	cfg, err := core.LoadConfig(format, input)
+	if err != nil {
+		return nil, newError(CodeConfigInvalid, err)
+	}
+	return cfg, nil
+}
+
+// configFormat returns the format of a config file from its extension,
+// json when the extension is unknown.
+func configFormat(path string) string {
+	format := core.GetFormatByExtension(strings.TrimPrefix(filepath.Ext(path), "."))
+	if format == "" {
+		return "json"
+	}
+	return format
+}
+
+// decodeConfig decodes data in one of the text formats with Xray's
+// decoders, and the tun section on its own, nil if there is none.
+func decodeConfig(format string, data []byte) (*conf.Config, *TunConfig, error) {
+	decode, ok := serial.ReaderDecoderByFormat[format]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown config format: %s", format)
+	}
+	c, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	tunCfg, err := decodeTunSection(format, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, tunCfg, nil
+}
+
+// decodeTunSection decodes the tun key of a config in one of the text
+// formats, which Xray's decoders do not know about.
+func decodeTunSection(format string, data []byte) (*TunConfig, error) {
+	temp := &struct {
+		Tun *TunConfig `json:"tun"`
+	}{}
+	switch format {
+	case "json":
+		data, err := io.ReadAll(&json_reader.Reader{Reader: bytes.NewReader(data)})
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, temp); err != nil {
+			return nil, err
+		}
+	case "yaml":
+		if err := yaml.Unmarshal(data, temp); err != nil {
+			return nil, err
+		}
+	case "toml":
+		m := make(map[string]any)
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		section, ok := m["tun"]
+		if !ok {
+			return nil, nil
+		}
+		data, err := json.Marshal(section)
+		if err != nil {
+			return nil, err
+		}
+		temp.Tun = &TunConfig{}
+		if err := json.Unmarshal(data, temp.Tun); err != nil {
+			return nil, err
+		}
+	}
+	return temp.Tun, nil
+}
+
+// loadConfigFiles reads the config fragments at paths, each in the format
+// given by its extension, and merges them in order with Xray's semantics:
+// sections of later fragments replace earlier ones, inbounds and outbounds
+// replace those with the same tag and are added otherwise, outbounds in
+// front unless the file name contains "tail". Routing is merged instead of
+// replaced: rules are put in front of the earlier ones, or behind them for
+// "tail" files, and balancers replace those with the same tag. The tun
+// section is taken from the last fragment having one, it is nil if none
+// has.
+func loadConfigFiles(paths []string) (*core.Config, *TunConfig, error) {
+	merged := &conf.Config{}
+	var tunCfg *TunConfig
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if stderrors.Is(err, os.ErrNotExist) {
+			return nil, nil, newError(CodeConfigNotFound, err)
+		} else if err != nil {
+			return nil, nil, err
+		}
+		c, t, err := decodeConfig(configFormat(path), data)
+		if err != nil {
+			return nil, nil, newError(CodeConfigInvalid, fmt.Errorf("%s: %v", path, err))
+		}
+		if t != nil {
+			tunCfg = t
+		}
+		if i == 0 {
+			*merged = *c
+			continue
+		}
+		routing := mergeRouting(merged.RouterConfig, c.RouterConfig, path)
+		merged.Override(c, path)
+		merged.RouterConfig = routing
+	}
+	cfg, err := merged.Build()
+	if err != nil {
+		return nil, nil, newError(CodeConfigInvalid, err)
+	}
+	return cfg, tunCfg, nil
+}
+
+func mergeRouting(base, o *conf.RouterConfig, path string) *conf.RouterConfig {
+	if base == nil || o == nil {
+		if o != nil {
+			return o
+		}
+		return base
+	}
+	merged := *base
+	if o.DomainStrategy != nil {
+		merged.DomainStrategy = o.DomainStrategy
+	}
+	if strings.Contains(strings.ToLower(path), "tail") {
+		merged.RuleList = append(append([]json.RawMessage{}, base.RuleList...), o.RuleList...)
+	} else {
+		merged.RuleList = append(append([]json.RawMessage{}, o.RuleList...), base.RuleList...)
+	}
+	merged.Balancers = append([]*conf.BalancingRule{}, base.Balancers...)
+	for _, b := range o.Balancers {
+		replaced := false
+		for i := range merged.Balancers {
+			if merged.Balancers[i].Tag == b.Tag {
+				merged.Balancers[i] = b
+				replaced = true
+				break
 			}
-		},
-	}))
+		}
+		if !replaced {
+			merged.Balancers = append(merged.Balancers, b)
+		}
+	}
+	return &merged
 }
@@ -1,45 +1,106 @@
 package app
 
 import (
-	"sync"
+	"time"
 
 	"vpn/app/ohos"
 
 	appLog "github.com/xtls/xray-core/app/log"
 	common "github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/errors"
 	commonLog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/signal/done"
+	"github.com/xtls/xray-core/common/signal/semaphore"
 )
 
-var _ commonLog.Writer = (*HiLog)(nil)
+var _ commonLog.Handler = (*HiLog)(nil)
 
+// HiLog hands every message together with its severity to write. Messages
+// without a severity, such as access logs, are written at Info. Like the
+// handler returned by commonLog.NewLogger, messages are queued and written
+// from a single goroutine, and dropped while the queue is full.
 type HiLog struct {
-	mutex sync.Mutex
-	write func(string) error
+	write  func(commonLog.Severity, string) error
+	buffer chan commonLog.Message
+	access *semaphore.Instance
+	done   *done.Instance
 }
 
-func CreateStdoutLogWriter(writer func(string) error) (commonLog.WriterCreator, error) {
-	return func() commonLog.Writer {
-		return &HiLog{write: writer}
-	}, nil
+func NewHiLog(write func(commonLog.Severity, string) error) *HiLog {
+	return &HiLog{
+		write:  write,
+		buffer: make(chan commonLog.Message, 16),
+		access: semaphore.New(1),
+		done:   done.New(),
+	}
 }
 
-func (log *HiLog) Write(s string) error {
-	log.mutex.Lock()
-	defer log.mutex.Unlock()
-	return log.write(s)
+func (log *HiLog) run() {
+	defer log.access.Signal()
+
+	dataWritten := false
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-log.done.Wait():
+			return
+		case msg := <-log.buffer:
+			severity := commonLog.Severity_Info
+			if m, ok := msg.(*commonLog.GeneralMessage); ok {
+				severity = m.Severity
+			}
+			log.write(severity, msg.String())
+			dataWritten = true
+		case <-ticker.C:
+			if !dataWritten {
+				return
+			}
+			dataWritten = false
+		}
+	}
+}
+
+func (log *HiLog) Handle(msg commonLog.Message) {
+	select {
+	case log.buffer <- msg:
+	default:
+	}
+
+	select {
+	case <-log.access.Wait():
+		go log.run()
+	default:
+	}
 }
 
 func (log *HiLog) Close() error {
-	log.mutex.Lock()
-	defer log.mutex.Unlock()
-	log.write = nil
-	return nil
+	return log.done.Close()
+}
+
+type multiHandler []commonLog.Handler
+
+func (h multiHandler) Handle(msg commonLog.Message) {
+	for _, handler := range h {
+		handler.Handle(msg)
+	}
+}
+
+// Close closes the handlers that can be closed.
+func (h multiHandler) Close() error {
+	var errs []error
+	for _, handler := range h {
+		errs = append(errs, common.Close(handler))
+	}
+	return errors.Combine(errs...)
 }
 
 func init() {
 	common.Must(appLog.RegisterHandlerCreator(appLog.LogType_Console, func(_ appLog.LogType, _ appLog.HandlerCreatorOptions) (commonLog.Handler, error) {
-		return commonLog.NewLogger(
-			common.Must2(CreateStdoutLogWriter(ohos.MustGetPlatformSupport().Log)),
-		), nil
+		return multiHandler{
+			NewHiLog(ohos.MustGetPlatformSupport().Log),
+			logs,
+		}, nil
 	}))
 }
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	commonLog "github.com/xtls/xray-core/common/log"
+)
+
+const (
+	logHistorySize = 256
+	logBacklogSize = 256
+)
+
+type LogEntry struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level"`
+	Message  string    `json:"message"`
+	severity commonLog.Severity
+}
+
+type LogStreamParams struct {
+	// Level is the least severe level delivered: "error", "warning", "info"
+	// or "debug". Empty means everything.
+	Level string `json:"level"`
+}
+
+var _ commonLog.Handler = (*LogHub)(nil)
+
+// LogHub keeps the most recent log lines and fans every new one out to the
+// subscribers of the control socket.
+type LogHub struct {
+	mutex       sync.Mutex
+	history     []LogEntry
+	next        int
+	subscribers map[*logSubscriber]struct{}
+}
+
+type logSubscriber struct {
+	level   commonLog.Severity
+	entries chan LogEntry
+}
+
+var logs = NewLogHub()
+
+func NewLogHub() *LogHub {
+	return &LogHub{
+		history:     make([]LogEntry, 0, logHistorySize),
+		subscribers: make(map[*logSubscriber]struct{}),
+	}
+}
+
+func (h *LogHub) Handle(msg commonLog.Message) {
+	severity := commonLog.Severity_Info
+	if m, ok := msg.(*commonLog.GeneralMessage); ok {
+		severity = m.Severity
+	}
+	entry := LogEntry{
+		Time:     time.Now(),
+		Level:    strings.ToLower(severity.String()),
+		Message:  msg.String(),
+		severity: severity,
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.history) < logHistorySize {
+		h.history = append(h.history, entry)
+	} else {
+		h.history[h.next] = entry
+		h.next = (h.next + 1) % logHistorySize
+	}
+	for sub := range h.subscribers {
+		sub.push(entry)
+	}
+}
+
+// Subscribe replays the buffered lines at or above level and then delivers
+// new ones through send until the returned cancel func is called. Nothing is
+// sent before start is called, and lines are queued until then. Lines are
+// dropped for subscribers that fall too far behind.
+func (h *LogHub) Subscribe(level commonLog.Severity, send func(LogEntry) error) (start, cancel func()) {
+	sub := &logSubscriber{
+		level:   level,
+		entries: make(chan LogEntry, logBacklogSize),
+	}
+	h.mutex.Lock()
+	for i := range h.history {
+		sub.push(h.history[(h.next+i)%len(h.history)])
+	}
+	h.subscribers[sub] = struct{}{}
+	h.mutex.Unlock()
+	start = func() {
+		go func() {
+			for entry := range sub.entries {
+				if send(entry) != nil {
+					break
+				}
+			}
+		}()
+	}
+	var once sync.Once
+	return start, func() {
+		once.Do(func() {
+			h.mutex.Lock()
+			delete(h.subscribers, sub)
+			close(sub.entries)
+			h.mutex.Unlock()
+		})
+	}
+}
+
+func (sub *logSubscriber) push(entry LogEntry) {
+	if entry.severity > sub.level {
+		return
+	}
+	select {
+	case sub.entries <- entry:
+	default:
+	}
+}
+
+func parseSeverity(level string) (commonLog.Severity, error) {
+	switch strings.ToLower(level) {
+	case "", "debug":
+		return commonLog.Severity_Debug, nil
+	case "info":
+		return commonLog.Severity_Info, nil
+	case "warning":
+		return commonLog.Severity_Warning, nil
+	case "error":
+		return commonLog.Severity_Error, nil
+	}
+	return commonLog.Severity_Unknown, fmt.Errorf("unknown log level: %s", level)
+}
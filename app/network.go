@@ -0,0 +1,114 @@
+//go:build linux
+
+package app
+
+import (
+	"context"
+	"io"
+	"sync"
+	"syscall"
+
+	"vpn/app/ohos"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// connRegistry remembers the sockets dialed by OHSystemDialer together with
+// the default device they are bound to. Sockets pinned to an interface by
+// sockopt are not tracked. Sockets are stored unwrapped so that Xray
+// still sees the concrete connection types, closed ones are pruned lazily.
+type connRegistry struct {
+	mutex sync.Mutex
+	conns map[io.Closer]string
+	prune int
+}
+
+var boundConns = &connRegistry{
+	conns: make(map[io.Closer]string),
+	prune: 256,
+}
+
+func (r *connRegistry) add(conn io.Closer, device string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.conns[conn] = device
+	if len(r.conns) >= r.prune {
+		for c := range r.conns {
+			if isClosed(c) {
+				delete(r.conns, c)
+			}
+		}
+		r.prune = max(256, 2*len(r.conns))
+	}
+}
+
+// closeExcept closes and forgets every socket not bound to device.
+func (r *connRegistry) closeExcept(device string) int {
+	r.mutex.Lock()
+	var stale []io.Closer
+	for c, d := range r.conns {
+		if d != device {
+			stale = append(stale, c)
+			delete(r.conns, c)
+		}
+	}
+	r.mutex.Unlock()
+	for _, c := range stale {
+		c.Close()
+	}
+	return len(stale)
+}
+
+func isClosed(c io.Closer) bool {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return true
+	}
+	return raw.Control(func(uintptr) {}) != nil
+}
+
+// NotifyNetworkChanged is called by the host when the default network moves
+// to ifname. Sockets bound to other interfaces are closed and the running
+// instances are rebuilt in place from the config they were started with,
+// which drops the DNS caches and makes the outbounds reconnect over the new
+// interface. The bootstrap resolver cache is dropped as well. An empty
+// ifname means the host did not say where the network moved, the new
+// default interface is then asked from the platform.
+func NotifyNetworkChanged(ifname string) error {
+	if ifname == "" {
+		ohos.InvalidateDefaultNetInterfaceName()
+		name, err := ohos.DefaultNetInterfaceName()
+		if err != nil {
+			return newError(CodeInternal, err)
+		}
+		ifname = name
+	}
+	prev, ok := ohos.SetDefaultNetInterfaceName(ifname)
+	if ok && prev == ifname {
+		return nil
+	}
+	closed := boundConns.closeExcept(ifname)
+	errors.LogInfo(context.Background(), "default network changed to ", ifname, ", closed ", closed, " connections")
+	mutex.Lock()
+	defer mutex.Unlock()
+	var err error
+	for _, h := range append([]*handle{primary}, allHandles()...) {
+		if h == nil || h.instance == nil {
+			continue
+		}
+		if rerr := h.rebuild(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	if lastStarted != nil {
+		// The config was validated when the instance was started.
+		if settings, serr := newSettings(lastStarted.config); serr == nil {
+			settings.apply()
+		}
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package ohos
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultNetInterfaceCacheTTL is how long a default interface name looked
+// up from the platform is reused.
+const DefaultNetInterfaceCacheTTL = 5 * time.Second
+
+var (
+	deviceMutex   sync.Mutex
+	device        string
+	deviceValid   bool
+	deviceExpires time.Time
+	deviceTTL     = DefaultNetInterfaceCacheTTL
+	notified      string
+	hasNotified   bool
+
+	// Lookup metrics of DefaultNetInterfaceName.
+	deviceLookups atomic.Int64
+	deviceHits    atomic.Int64
+	deviceErrors  atomic.Int64
+)
+
+// DefaultNetInterfaceName returns the cached default interface name, asking
+// the platform when the cache is empty or expired.
+func DefaultNetInterfaceName() (string, error) {
+	deviceLookups.Add(1)
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	if deviceValid && (deviceExpires.IsZero() || time.Now().Before(deviceExpires)) {
+		deviceHits.Add(1)
+		return device, nil
+	}
+	ps, err := GetPlatformSupport()
+	if err != nil {
+		deviceErrors.Add(1)
+		return "", err
+	}
+	name, err := ps.GetDefaultNetInterfaceName()
+	if err != nil {
+		deviceErrors.Add(1)
+		return "", err
+	}
+	fillDeviceCache(name)
+	return name, nil
+}
+
+// SetDefaultNetInterfaceName records name, reported by the host on a
+// network change, as the default interface and returns the name reported
+// before.
+func SetDefaultNetInterfaceName(name string) (prev string, ok bool) {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	prev, ok = notified, hasNotified
+	notified, hasNotified = name, true
+	fillDeviceCache(name)
+	return prev, ok
+}
+
+// InvalidateDefaultNetInterfaceName drops the cached name so the next
+// lookup asks the platform.
+func InvalidateDefaultNetInterfaceName() {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	deviceValid = false
+}
+
+// SetDefaultNetInterfaceCacheTTL sets how long a cached name is reused. Zero
+// keeps it until invalidated, a negative ttl disables the cache.
+func SetDefaultNetInterfaceCacheTTL(ttl time.Duration) {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	if ttl == deviceTTL {
+		return
+	}
+	deviceTTL = ttl
+	deviceValid = false
+}
+
+func fillDeviceCache(name string) {
+	if deviceTTL < 0 {
+		deviceValid = false
+		return
+	}
+	device, deviceValid = name, true
+	deviceExpires = time.Time{}
+	if deviceTTL > 0 {
+		deviceExpires = time.Now().Add(deviceTTL)
+	}
+}
+
+// VisitCounters calls fn with the lookup metrics of the default interface
+// cache, named like Xray stats counters.
+func VisitCounters(fn func(name string, c *atomic.Int64)) {
+	fn("ohos>>>defaultInterface>>>lookups", &deviceLookups)
+	fn("ohos>>>defaultInterface>>>hits", &deviceHits)
+	fn("ohos>>>defaultInterface>>>errors", &deviceErrors)
+}
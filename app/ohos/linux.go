@@ -0,0 +1,157 @@
+//go:build linux
+
+package ohos
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commonLog "github.com/xtls/xray-core/common/log"
+)
+
+// Log targets of LinuxSupport.
+const (
+	LogStderr = "stderr"
+	LogSyslog = "syslog"
+)
+
+// LogEnv selects the log target of the LinuxSupport used when no
+// PlatformSupport is registered.
+const LogEnv = "VPN_PLATFORM_LOG"
+
+func init() {
+	fallback = func() (PlatformSupport, error) {
+		return NewLinuxSupport(os.Getenv(LogEnv))
+	}
+}
+
+// LinuxSupport is a pure Go PlatformSupport for plain Linux hosts, used on
+// desktops and in CI where the OHOS host is not available.
+type LinuxSupport struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	syslog *syslog.Writer
+}
+
+// NewLinuxSupport returns a LinuxSupport logging to target, LogStderr or
+// LogSyslog.
+func NewLinuxSupport(target string) (*LinuxSupport, error) {
+	switch target {
+	case "", LogStderr:
+		return &LinuxSupport{out: os.Stderr}, nil
+	case LogSyslog:
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "vpn")
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		return &LinuxSupport{syslog: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown log target: %s", target)
+	}
+}
+
+func (s *LinuxSupport) Log(severity commonLog.Severity, message string) error {
+	if s.syslog != nil {
+		switch severity {
+		case commonLog.Severity_Debug:
+			return s.syslog.Debug(message)
+		case commonLog.Severity_Warning:
+			return s.syslog.Warning(message)
+		case commonLog.Severity_Error:
+			return s.syslog.Err(message)
+		}
+		return s.syslog.Info(message)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := fmt.Fprintf(s.out, "%s %s\n", time.Now().Format("2006/01/02 15:04:05.000000"), message)
+	return err
+}
+
+// GetDefaultNetInterfaceName returns the interface of the IPv4 default
+// route with the lowest metric, falling back to the IPv6 default route.
+func (s *LinuxSupport) GetDefaultNetInterfaceName() (string, error) {
+	if name, err := defaultRoute4("/proc/net/route"); err == nil && name != "" {
+		return name, nil
+	}
+	name, err := defaultRoute6("/proc/net/ipv6_route")
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("no default route")
+	}
+	return name, nil
+}
+
+// rtfUp is RTF_UP from linux/route.h.
+const rtfUp = 0x1
+
+// defaultRoute4 parses /proc/net/route, whose columns are Iface,
+// Destination, Gateway, Flags, RefCnt, Use, Metric, Mask, ...
+func defaultRoute4(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	name, best := "", uint64(0)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfUp == 0 {
+			continue
+		}
+		metric, err := strconv.ParseUint(fields[6], 10, 32)
+		if err != nil {
+			continue
+		}
+		if name == "" || metric < best {
+			name, best = fields[0], metric
+		}
+	}
+	return name, scanner.Err()
+}
+
+// defaultRoute6 parses /proc/net/ipv6_route, whose columns are destination,
+// prefix length, source, source prefix length, next hop, metric, refcnt,
+// use, flags and device.
+func defaultRoute6(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	name, best := "", uint64(0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" || fields[9] == "lo" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[8], 16, 32)
+		if err != nil || flags&rtfUp == 0 {
+			continue
+		}
+		metric, err := strconv.ParseUint(fields[5], 16, 32)
+		if err != nil {
+			continue
+		}
+		if name == "" || metric < best {
+			name, best = fields[9], metric
+		}
+	}
+	return name, scanner.Err()
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package ohos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const routeHeader = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+func writeFixture(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "route")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultRoute4(t *testing.T) {
+	tests := []struct {
+		name  string
+		route string
+		want  string
+	}{
+		{
+			name: "no default route",
+			route: routeHeader +
+				"eth0\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+			want: "",
+		},
+		{
+			name: "default route",
+			route: routeHeader +
+				"eth0\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+				"eth0\t00000000\t010200C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			want: "eth0",
+		},
+		{
+			name: "lowest metric wins",
+			route: routeHeader +
+				"wlan0\t00000000\t0100A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n" +
+				"rmnet0\t00000000\t0100000A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+				"eth0\t00000000\t010200C0\t0003\t0\t0\t300\t00000000\t0\t0\t0\n",
+			want: "rmnet0",
+		},
+		{
+			name: "route not up",
+			route: routeHeader +
+				"rmnet0\t00000000\t0100000A\t0002\t0\t0\t100\t00000000\t0\t0\t0\n" +
+				"wlan0\t00000000\t0100A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n",
+			want: "wlan0",
+		},
+		{
+			name: "only down routes",
+			route: routeHeader +
+				"rmnet0\t00000000\t0100000A\t0002\t0\t0\t100\t00000000\t0\t0\t0\n",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := defaultRoute4(writeFixture(t, tt.route))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultRoute6(t *testing.T) {
+	const (
+		unspec   = "00000000000000000000000000000000 00 00000000000000000000000000000000 00 "
+		linkNet  = "fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     wlan0\n"
+		loopback = unspec + "00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n"
+	)
+	tests := []struct {
+		name  string
+		route string
+		want  string
+	}{
+		{
+			name:  "no default route",
+			route: linkNet,
+			want:  "",
+		},
+		{
+			name: "default route",
+			route: linkNet +
+				unspec + "fe800000000000000000000000000001 00000400 00000001 00000000 00000003     wlan0\n",
+			want: "wlan0",
+		},
+		{
+			name: "lowest metric wins",
+			route: unspec + "fe800000000000000000000000000001 00000400 00000001 00000000 00000003     wlan0\n" +
+				unspec + "fe800000000000000000000000000002 00000100 00000001 00000000 00000003   rmnet0\n" +
+				unspec + "fe800000000000000000000000000003 00000200 00000001 00000000 00000003     eth0\n",
+			want: "rmnet0",
+		},
+		{
+			name: "route not up",
+			route: unspec + "fe800000000000000000000000000002 00000100 00000001 00000000 00000002   rmnet0\n" +
+				unspec + "fe800000000000000000000000000001 00000400 00000001 00000000 00000003     wlan0\n",
+			want: "wlan0",
+		},
+		{
+			name:  "lo unreachable route",
+			route: linkNet + loopback,
+			want:  "",
+		},
+		{
+			name: "lo unreachable route next to a default route",
+			route: loopback +
+				unspec + "fe800000000000000000000000000001 00000400 00000001 00000000 00000003     wlan0\n",
+			want: "wlan0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := defaultRoute6(writeFixture(t, tt.route))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,24 +2,43 @@ package ohos
 
 import (
 	"errors"
+	"sync"
 
 	common "github.com/xtls/xray-core/common"
+	commonLog "github.com/xtls/xray-core/common/log"
 )
 
-var instance PlatformSupport
+var (
+	instance PlatformSupport
+	mutex    sync.Mutex
+
+	// fallback creates the PlatformSupport used when none is registered.
+	fallback func() (PlatformSupport, error)
+)
 
 type PlatformSupport interface {
-	Log(string) error
+	Log(commonLog.Severity, string) error
 	GetDefaultNetInterfaceName() (string, error)
 }
 
 func RegisterPlatformSupport(ps PlatformSupport) {
+	mutex.Lock()
+	defer mutex.Unlock()
 	instance = ps
 }
 
 func GetPlatformSupport() (PlatformSupport, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
 	if instance == nil {
-		return nil, errors.New("")
+		if fallback == nil {
+			return nil, errors.New("no platform support registered")
+		}
+		ps, err := fallback()
+		if err != nil {
+			return nil, err
+		}
+		instance = ps
 	}
 	return instance, nil
 }
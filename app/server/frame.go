@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// MaxFrameSize bounds the payload of a single frame.
+const MaxFrameSize = 1 << 20
+
+// Request is a method call sent by a client. ID is echoed in the response so
+// that clients may pipeline calls.
+type Request struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response answers the request with the same ID. Subscriptions additionally
+// receive any number of responses that carry only an Event.
+type Response struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Event  json.RawMessage `json:"event,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ReadFrame reads a frame, a 4-byte big-endian length followed by that many
+// bytes of JSON, and decodes it into v.
+func ReadFrame(r io.Reader, v any) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > MaxFrameSize {
+		return fmt.Errorf("frame too large: %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteFrame encodes v as JSON and writes it as a single frame.
+func WriteFrame(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("frame too large: %d", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
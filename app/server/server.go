@@ -2,18 +2,33 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"sync"
 
 	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/errors"
 )
 
 type Config struct {
-	Path string
+	Path     string
+	Handlers map[string]Handler
+	Streams  map[string]Stream
 }
 
+// Handler serves a single method call. If done is not nil it is run after
+// the response has been written, which lets a method tear down the server.
+type Handler func(params json.RawMessage) (result any, done func(), err error)
+
+// Stream subscribes a connection to a sequence of events. Every value passed
+// to send is written to the client as an event carrying the request ID.
+// start is called once the response accepting the subscription has been
+// written, and send must not be used before that. cancel is called once the
+// connection goes away.
+type Stream func(params json.RawMessage, send func(event any) error) (start, cancel func(), err error)
+
 func init() {
 	common.Must(common.RegisterConfig((*Config)(nil), func(ctx context.Context, cfg any) (any, error) {
 		return New(ctx, cfg.(*Config))
@@ -23,6 +38,8 @@ func init() {
 type Server struct {
 	ctx      context.Context
 	listener net.Listener
+	handlers map[string]Handler
+	streams  map[string]Stream
 	conns    map[net.Conn]struct{}
 	mutex    sync.Mutex
 }
@@ -40,6 +57,8 @@ func New(ctx context.Context, cfg *Config) (*Server, error) {
 	return &Server{
 		ctx:      ctx,
 		listener: listener,
+		handlers: cfg.Handlers,
+		streams:  cfg.Streams,
 		conns:    make(map[net.Conn]struct{}),
 	}, nil
 }
@@ -75,5 +94,88 @@ func (s *Server) acceptLoop() {
 		s.mutex.Lock()
 		s.conns[conn] = struct{}{}
 		s.mutex.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	var (
+		wmutex  sync.Mutex
+		cancels []func()
+	)
+	write := func(rsp *Response) error {
+		wmutex.Lock()
+		defer wmutex.Unlock()
+		return WriteFrame(conn, rsp)
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	for {
+		req := &Request{}
+		if err := ReadFrame(conn, req); err != nil {
+			errors.LogDebugInner(s.ctx, err, "control connection ends")
+			return
+		}
+		if stream, ok := s.streams[req.Method]; ok {
+			rsp := &Response{ID: req.ID}
+			start, cancel, err := stream(req.Params, func(event any) error {
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				return write(&Response{ID: req.ID, Event: data})
+			})
+			if err != nil {
+				rsp.Error = err.Error()
+			} else {
+				cancels = append(cancels, cancel)
+			}
+			if err := write(rsp); err != nil {
+				errors.LogDebugInner(s.ctx, err, "failed to write control response")
+				return
+			}
+			if start != nil {
+				start()
+			}
+			continue
+		}
+		rsp, done := s.call(req)
+		if err := write(rsp); err != nil {
+			errors.LogDebugInner(s.ctx, err, "failed to write control response")
+			return
+		}
+		if done != nil {
+			done()
+		}
+	}
+}
+
+func (s *Server) call(req *Request) (*Response, func()) {
+	rsp := &Response{ID: req.ID}
+	handler, ok := s.handlers[req.Method]
+	if !ok {
+		rsp.Error = "unknown method: " + req.Method
+		return rsp, nil
+	}
+	result, done, err := handler(req.Params)
+	if err != nil {
+		rsp.Error = err.Error()
+		return rsp, nil
+	}
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			rsp.Error = err.Error()
+			return rsp, nil
+		}
+		rsp.Result = data
 	}
+	return rsp, done
 }
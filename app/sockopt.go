@@ -0,0 +1,82 @@
+//go:build linux
+
+package app
+
+import (
+	"fmt"
+	gonet "net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/xtls/xray-core/transport/internet"
+	"golang.org/x/sys/unix"
+)
+
+// applySocketOptions applies the Linux subset of sockopt to fd. Domain
+// strategy and dialerProxy are resolved by internet.DialSystem before the
+// system dialer is reached, the bound interface by OHSystemDialer.bind.
+func applySocketOptions(network string, fd int, sockopt *internet.SocketConfig) error {
+	if sockopt.Mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(sockopt.Mark)); err != nil {
+			return fmt.Errorf("failed to set SO_MARK: %v", err)
+		}
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	if tfo := sockopt.ParseTFOValue(); tfo >= 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_TCP, unix.TCP_FASTOPEN_CONNECT, min(tfo, 1)); err != nil {
+			return fmt.Errorf("failed to set TCP_FASTOPEN_CONNECT: %v", err)
+		}
+	}
+	if sockopt.TcpCongestion != "" {
+		if err := syscall.SetsockoptString(fd, syscall.SOL_TCP, syscall.TCP_CONGESTION, sockopt.TcpCongestion); err != nil {
+			return fmt.Errorf("failed to set TCP_CONGESTION: %v", err)
+		}
+	}
+	if sockopt.TcpWindowClamp > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_WINDOW_CLAMP, int(sockopt.TcpWindowClamp)); err != nil {
+			return fmt.Errorf("failed to set TCP_WINDOW_CLAMP: %v", err)
+		}
+	}
+	if sockopt.TcpUserTimeout > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(sockopt.TcpUserTimeout)); err != nil {
+			return fmt.Errorf("failed to set TCP_USER_TIMEOUT: %v", err)
+		}
+	}
+	if sockopt.TcpMaxSeg > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, int(sockopt.TcpMaxSeg)); err != nil {
+			return fmt.Errorf("failed to set TCP_MAXSEG: %v", err)
+		}
+	}
+	return nil
+}
+
+// keepAlive returns the keep-alive settings of a TCP dialer for sockopt,
+// following Xray's default system dialer. Without sockopt the Go defaults
+// are kept.
+func keepAlive(sockopt *internet.SocketConfig) (time.Duration, gonet.KeepAliveConfig, error) {
+	if sockopt == nil {
+		return 0, gonet.KeepAliveConfig{}, nil
+	}
+	if sockopt.TcpKeepAliveIdle*sockopt.TcpKeepAliveInterval < 0 {
+		return 0, gonet.KeepAliveConfig{}, fmt.Errorf("invalid tcpKeepAliveIdle or tcpKeepAliveInterval: %d %d", sockopt.TcpKeepAliveIdle, sockopt.TcpKeepAliveInterval)
+	}
+	config := gonet.KeepAliveConfig{
+		Enable:   true,
+		Idle:     45 * time.Second,
+		Interval: 45 * time.Second,
+		Count:    -1,
+	}
+	if sockopt.TcpKeepAliveIdle < 0 || sockopt.TcpKeepAliveInterval < 0 {
+		return -1, gonet.KeepAliveConfig{}, nil
+	}
+	if sockopt.TcpKeepAliveIdle > 0 {
+		config.Idle = time.Duration(sockopt.TcpKeepAliveIdle) * time.Second
+	}
+	if sockopt.TcpKeepAliveInterval > 0 {
+		config.Interval = time.Duration(sockopt.TcpKeepAliveInterval) * time.Second
+	}
+	return 0, config, nil
+}
@@ -0,0 +1,126 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// linkTypeRaw is LINKTYPE_RAW, packets starting with an IPv4 or IPv6 header.
+const linkTypeRaw = 101
+
+type Config struct {
+	Path string
+	// SnapLen truncates every packet, MaxPackets and MaxBytes stop the
+	// capture once reached. Zero means the default snap length or no limit.
+	SnapLen    int
+	MaxPackets int
+	MaxBytes   int64
+}
+
+// Writer records packets to a pcap file until it is closed or one of its
+// limits is reached.
+type Writer struct {
+	mutex   sync.Mutex
+	cfg     Config
+	file    *os.File
+	w       *bufio.Writer
+	packets int
+	bytes   int64
+	done    bool
+}
+
+func New(cfg Config) (*Writer, error) {
+	if cfg.SnapLen <= 0 {
+		cfg.SnapLen = 65535
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %v", err)
+	}
+	w := &Writer{
+		cfg:  cfg,
+		file: file,
+		w:    bufio.NewWriterSize(file, 64<<10),
+	}
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(cfg.SnapLen))
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := w.w.Write(hdr); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// WritePacket records a packet given as a list of slices.
+func (w *Writer) WritePacket(data [][]byte) {
+	length := 0
+	for _, d := range data {
+		length += len(d)
+	}
+	captured := min(length, w.cfg.SnapLen)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done {
+		return
+	}
+	now := time.Now()
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(captured))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(length))
+	w.w.Write(rec)
+	remaining := captured
+	for _, d := range data {
+		if remaining == 0 {
+			break
+		}
+		n := min(len(d), remaining)
+		w.w.Write(d[:n])
+		remaining -= n
+	}
+	w.packets++
+	w.bytes += int64(len(rec) + captured)
+	if (w.cfg.MaxPackets > 0 && w.packets >= w.cfg.MaxPackets) || (w.cfg.MaxBytes > 0 && w.bytes >= w.cfg.MaxBytes) {
+		w.closeLocked()
+	}
+}
+
+func (w *Writer) Path() string {
+	return w.cfg.Path
+}
+
+// Stats returns the number of packets and bytes recorded so far and whether
+// the capture has ended.
+func (w *Writer) Stats() (packets int, bytes int64, done bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.packets, w.bytes, w.done
+}
+
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.closeLocked()
+}
+
+func (w *Writer) closeLocked() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	err := w.w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package tun
+
+import (
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/stats"
+)
+
+var _ stats.Counter = (*Counter)(nil)
+
+// Counter counts the bytes of a single flow and adds them to an aggregate
+// counter registered with the stats manager, if there is one.
+type Counter struct {
+	value  atomic.Int64
+	parent stats.Counter
+}
+
+func NewCounter(parent stats.Counter) *Counter {
+	return &Counter{parent: parent}
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+func (c *Counter) Set(v int64) int64 {
+	return c.value.Swap(v)
+}
+
+func (c *Counter) Add(delta int64) int64 {
+	if c.parent != nil {
+		c.parent.Add(delta)
+	}
+	return c.value.Add(delta)
+}
+
+// inboundCounters returns the uplink and downlink counters of the inbound
+// tag, following the same naming and policy switches as proxyman inbounds.
+// Per outbound totals are kept by the outbound handlers themselves.
+func inboundCounters(v *core.Instance, tag string) (stats.Counter, stats.Counter) {
+	var uplink, downlink stats.Counter
+	if len(tag) == 0 {
+		return nil, nil
+	}
+	plcy := v.GetFeature(policy.ManagerType()).(policy.Manager).ForSystem()
+	manager, ok := v.GetFeature(stats.ManagerType()).(stats.Manager)
+	if !ok {
+		return nil, nil
+	}
+	if plcy.Stats.InboundUplink {
+		uplink, _ = stats.GetOrRegisterCounter(manager, "inbound>>>"+tag+">>>traffic>>>uplink")
+	}
+	if plcy.Stats.InboundDownlink {
+		downlink, _ = stats.GetOrRegisterCounter(manager, "inbound>>>"+tag+">>>traffic>>>downlink")
+	}
+	return uplink, downlink
+}
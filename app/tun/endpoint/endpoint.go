@@ -2,37 +2,78 @@ package endpoint
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
+	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/buffer"
-	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
+// batchSize is the largest number of packets read or written per wakeup.
+const batchSize = 64
+
 type Endpoint struct {
 	*channel.Endpoint
-	fd   int
-	mtu  int
-	once sync.Once
-	wg   sync.WaitGroup
-	pool sync.Pool
+	fd        int
+	closeFd   bool
+	blocking  bool
+	file      *os.File
+	conn      syscall.RawConn
+	mtu       int
+	once      sync.Once
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	// iovecs is only used while holding the write lock of conn.
+	iovecs []syscall.Iovec
+
+	intercept atomic.Pointer[func([]byte) bool]
+	tap       atomic.Pointer[func([][]byte)]
 }
 
-func New(fd, mtu int) *Endpoint {
+// New returns an endpoint reading and writing packets on a duplicate of fd,
+// driven by the Go runtime poller. The duplicate shares the file status
+// flags of fd, so fd is nonblocking while the endpoint is open; Close puts
+// it back into blocking mode if it was blocking before. If closeFd is set
+// the endpoint takes ownership of fd and closes it in Close.
+func New(fd, mtu int, closeFd bool) (*Endpoint, error) {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tun fd flags: %v", err)
+	}
+	nfd, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dup tun fd: %v", err)
+	}
+	syscall.CloseOnExec(nfd)
+	if err := syscall.SetNonblock(nfd, true); err != nil {
+		syscall.Close(nfd)
+		return nil, fmt.Errorf("failed to set tun fd nonblocking: %v", err)
+	}
+	file := os.NewFile(uintptr(nfd), "tun")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get raw tun conn: %v", err)
+	}
 	return &Endpoint{
 		Endpoint: channel.New(1<<10, uint32(mtu), ""),
 		fd:       fd,
+		closeFd:  closeFd,
+		blocking: flags&unix.O_NONBLOCK == 0,
+		file:     file,
+		conn:     conn,
 		mtu:      mtu,
-		pool: sync.Pool{
-			New: func() any {
-				return make([]syscall.Iovec, 0, 64)
-			},
-		},
-	}
+		iovecs:   make([]syscall.Iovec, 0, 64),
+	}, nil
 }
 
 func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
@@ -51,79 +92,208 @@ func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
 	})
 }
 
+// Intercept installs fn to see every packet read from the fd before it is
+// injected into the stack. Packets for which fn returns true are consumed by
+// fn. data is only valid for the duration of the call. A nil fn removes the
+// interceptor.
+func (e *Endpoint) Intercept(fn func(data []byte) bool) {
+	if fn == nil {
+		e.intercept.Store(nil)
+		return
+	}
+	e.intercept.Store(&fn)
+}
+
+// Tap installs fn to see a copy of every packet read from or written to the
+// fd, such as a packet capture. data is only valid for the duration of the
+// call. A nil fn removes the tap.
+func (e *Endpoint) Tap(fn func(data [][]byte)) {
+	if fn == nil {
+		e.tap.Store(nil)
+		return
+	}
+	e.tap.Store(&fn)
+}
+
+// WriteRaw writes a raw IP packet to the fd, bypassing the stack.
+func (e *Endpoint) WriteRaw(data []byte) error {
+	var werr error
+	err := e.conn.Write(func(fd uintptr) bool {
+		werr = e.writev(fd, [][]byte{data})
+		return werr != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	if werr == nil {
+		e.tapPacket([][]byte{data})
+	}
+	return werr
+}
+
+// Close stops both loops by closing the outbound queue and the duplicated
+// fd, and waits for them to return. The fd passed to New is closed as well
+// if the endpoint owns it, otherwise its blocking mode is restored. Close
+// must not be called with stack locks held.
+func (e *Endpoint) Close() {
+	e.closeOnce.Do(func() {
+		e.Endpoint.Close()
+		e.file.Close()
+		e.wg.Wait()
+		if e.closeFd {
+			syscall.Close(e.fd)
+		} else if e.blocking {
+			syscall.SetNonblock(e.fd, false)
+		}
+	})
+}
+
 func (e *Endpoint) Wait() {
 	e.wg.Wait()
 }
 
 func (e *Endpoint) dispatchLoop(cancel context.CancelFunc) {
 	defer cancel()
+	views := make([]*buffer.View, 0, batchSize)
 	for {
-		data := make([]byte, e.mtu)
-		n, err := e.read(e.fd, data)
-		if err != nil {
-			break
-		}
-		if n == 0 || n > e.mtu {
-			continue
+		var err error
+		views, err = e.readBatch(views[:0])
+		for _, v := range views {
+			e.deliver(v)
 		}
-		if !e.IsAttached() {
-			continue
+		if err != nil {
+			return
 		}
-		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Payload: buffer.MakeWithData(data[:n]),
-		})
-		switch header.IPVersion(data) {
-		case header.IPv4Version:
-			e.InjectInbound(header.IPv4ProtocolNumber, pkt)
-		case header.IPv6Version:
-			e.InjectInbound(header.IPv6ProtocolNumber, pkt)
+	}
+}
+
+// readBatch waits until the fd is readable and then reads packets until it
+// would block again or the batch is full.
+func (e *Endpoint) readBatch(views []*buffer.View) ([]*buffer.View, error) {
+	var rerr error
+	err := e.conn.Read(func(fd uintptr) bool {
+		for len(views) < cap(views) {
+			v := buffer.NewViewSize(e.mtu)
+			n, err := syscall.Read(int(fd), v.AsSlice())
+			if err != nil {
+				v.Release()
+				switch err {
+				case syscall.EINTR:
+					continue
+				case syscall.EAGAIN:
+					return len(views) > 0
+				}
+				rerr = err
+				return true
+			}
+			if n == 0 {
+				v.Release()
+				rerr = io.EOF
+				return true
+			}
+			v.CapLength(n)
+			views = append(views, v)
 		}
-		pkt.DecRef()
+		return true
+	})
+	if err != nil {
+		return views, err
+	}
+	return views, rerr
+}
+
+func (e *Endpoint) deliver(v *buffer.View) {
+	data := v.AsSlice()
+	if !e.IsAttached() {
+		v.Release()
+		return
+	}
+	e.tapPacket([][]byte{data})
+	if fn := e.intercept.Load(); fn != nil && (*fn)(data) {
+		v.Release()
+		return
+	}
+	proto := header.IPv4ProtocolNumber
+	switch header.IPVersion(data) {
+	case header.IPv4Version:
+	case header.IPv6Version:
+		proto = header.IPv6ProtocolNumber
+	default:
+		v.Release()
+		return
 	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithView(v),
+	})
+	e.InjectInbound(proto, pkt)
+	pkt.DecRef()
 }
 
 func (e *Endpoint) outboundLoop(ctx context.Context) {
+	pkts := make([]*stack.PacketBuffer, 0, batchSize)
 	for {
 		pkt := e.ReadContext(ctx)
 		if pkt == nil {
 			break
 		}
-		e.writePacket(pkt)
+		pkts = append(pkts[:0], pkt)
+		for len(pkts) < batchSize {
+			if pkt = e.Read(); pkt == nil {
+				break
+			}
+			pkts = append(pkts, pkt)
+		}
+		e.writePackets(pkts)
 	}
 }
 
-func (e *Endpoint) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
-	defer pkt.DecRef()
-	if _, err := e.write(e.fd, pkt.AsSlices()); err != nil {
-		return &tcpip.ErrInvalidEndpointState{}
-	}
-	return nil
+// writePackets writes all of pkts within a single wait for writability.
+// Packets failing with anything but EAGAIN are dropped.
+func (e *Endpoint) writePackets(pkts []*stack.PacketBuffer) {
+	defer func() {
+		for _, pkt := range pkts {
+			pkt.DecRef()
+		}
+	}()
+	i := 0
+	e.conn.Write(func(fd uintptr) bool {
+		for ; i < len(pkts); i++ {
+			data := pkts[i].AsSlices()
+			err := e.writev(fd, data)
+			if err == syscall.EAGAIN {
+				return false
+			}
+			if err == nil {
+				e.tapPacket(data)
+			}
+		}
+		return true
+	})
 }
 
-func (e *Endpoint) read(fd int, p []byte) (n int, err error) {
-	return syscall.Read(fd, p)
+func (e *Endpoint) tapPacket(data [][]byte) {
+	if fn := e.tap.Load(); fn != nil {
+		(*fn)(data)
+	}
 }
 
-func (e *Endpoint) write(fd int, ps [][]byte) (n int, err error) {
-	count := len(ps)
-	if count == 0 {
-		return 0, nil
-	}
-	iovs := e.pool.Get().([]syscall.Iovec)
-	iovs = iovs[:count]
-	for i, p := range ps {
+func (e *Endpoint) writev(fd uintptr, ps [][]byte) error {
+	iovs := e.iovecs[:0]
+	for _, p := range ps {
 		if len(p) > 0 {
-			iovs[i].Base = &p[0]
-			iovs[i].Len = uint64(len(p))
+			iovs = append(iovs, syscall.Iovec{Base: &p[0], Len: uint64(len(p))})
 		}
 	}
-	r, _, err := syscall.Syscall(syscall.SYS_WRITEV,
-		uintptr(fd),
+	e.iovecs = iovs
+	if len(iovs) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_WRITEV,
+		fd,
 		uintptr(unsafe.Pointer(&iovs[0])),
-		uintptr(count))
-
-	if err != syscall.Errno(0) {
-		return int(r), err
+		uintptr(len(iovs)))
+	if errno != 0 {
+		return errno
 	}
-	return int(r), nil
+	return nil
 }
@@ -0,0 +1,256 @@
+package endpoint
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type nopDispatcher struct{}
+
+func (nopDispatcher) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {}
+
+func (nopDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {}
+
+func socketpair(t testing.TB) (int, int) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+	})
+	return fds[0], fds[1]
+}
+
+func TestCloseNoLeak(t *testing.T) {
+	fd, _ := socketpair(t)
+	base := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		e, err := New(fd, 1500, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Attach(nopDispatcher{})
+		done := make(chan struct{})
+		go func() {
+			e.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle %d: Close did not return", i)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d, started with %d", runtime.NumGoroutine(), base)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseRestoresBlocking(t *testing.T) {
+	fd, _ := socketpair(t)
+	e, err := New(fd, 1500, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Attach(nopDispatcher{})
+	if !nonblocking(t, fd) {
+		t.Fatal("fd is blocking while the endpoint is open")
+	}
+	e.Close()
+	if nonblocking(t, fd) {
+		t.Fatal("fd is still nonblocking after Close")
+	}
+}
+
+func nonblocking(t *testing.T, fd int) bool {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags&unix.O_NONBLOCK != 0
+}
+
+// countDispatcher counts delivered packets and closes done after n.
+type countDispatcher struct {
+	n     int64
+	count atomic.Int64
+	done  chan struct{}
+}
+
+func newCountDispatcher(n int) *countDispatcher {
+	return &countDispatcher{n: int64(n), done: make(chan struct{})}
+}
+
+func (d *countDispatcher) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+	if d.count.Add(1) == d.n {
+		close(d.done)
+	}
+}
+
+func (d *countDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {}
+
+const benchMTU = 1500
+
+func benchPacket() []byte {
+	data := make([]byte, 1280)
+	data[0] = 0x45
+	return data
+}
+
+// perPacketRead is the read loop the endpoint used before batching: a fresh
+// buffer and one blocking read per packet.
+func perPacketRead(fd int, ep *channel.Endpoint) {
+	for {
+		data := make([]byte, benchMTU)
+		n, err := syscall.Read(fd, data)
+		if err != nil || n == 0 {
+			return
+		}
+		pkt := newPacket(data[:n])
+		ep.InjectInbound(header.IPv4ProtocolNumber, pkt)
+		pkt.DecRef()
+	}
+}
+
+// perPacketWrite is the write path the endpoint used before batching: one
+// blocking writev per packet.
+func perPacketWrite(fd int, pkt *stack.PacketBuffer) {
+	var iovs []syscall.Iovec
+	for _, p := range pkt.AsSlices() {
+		iovs = append(iovs, syscall.Iovec{Base: &p[0], Len: uint64(len(p))})
+	}
+	syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd),
+		uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	pkt.DecRef()
+}
+
+// peerFile returns fd as a nonblocking file so that the peer side of a
+// benchmark waits in the runtime poller rather than in a blocking syscall.
+func peerFile(b *testing.B, fd int) *os.File {
+	nfd, err := syscall.Dup(fd)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := syscall.SetNonblock(nfd, true); err != nil {
+		b.Fatal(err)
+	}
+	f := os.NewFile(uintptr(nfd), "peer")
+	b.Cleanup(func() { f.Close() })
+	return f
+}
+
+// writePeer writes n packets to f from a separate goroutine.
+func writePeer(f *os.File, n int) {
+	go func() {
+		data := benchPacket()
+		for i := 0; i < n; i++ {
+			if _, err := f.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// readPeer reads n packets from f and closes the returned channel.
+func readPeer(f *os.File, n int) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		data := make([]byte, benchMTU)
+		for i := 0; i < n; i++ {
+			if _, err := f.Read(data); err != nil {
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func newPacket(data []byte) *stack.PacketBuffer {
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(data),
+	})
+}
+
+func reportRate(b *testing.B) {
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func BenchmarkEndpoint(b *testing.B) {
+	b.Run("read/batched", func(b *testing.B) {
+		fd, peer := socketpair(b)
+		e, err := New(fd, benchMTU, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer e.Close()
+		d := newCountDispatcher(b.N)
+		e.Attach(d)
+		b.ResetTimer()
+		writePeer(peerFile(b, peer), b.N)
+		<-d.done
+		reportRate(b)
+	})
+	b.Run("read/perPacket", func(b *testing.B) {
+		fd, peer := socketpair(b)
+		ep := channel.New(1<<10, benchMTU, "")
+		d := newCountDispatcher(b.N)
+		ep.Attach(d)
+		go perPacketRead(fd, ep)
+		defer syscall.Shutdown(peer, syscall.SHUT_WR)
+		b.ResetTimer()
+		writePeer(peerFile(b, peer), b.N)
+		<-d.done
+		reportRate(b)
+	})
+	b.Run("write/batched", func(b *testing.B) {
+		fd, peer := socketpair(b)
+		e, err := New(fd, benchMTU, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer e.Close()
+		data := benchPacket()
+		pkts := make([]*stack.PacketBuffer, 0, batchSize)
+		b.ResetTimer()
+		done := readPeer(peerFile(b, peer), b.N)
+		for i := 0; i < b.N; i += len(pkts) {
+			pkts = pkts[:0]
+			for j := i; j < b.N && len(pkts) < batchSize; j++ {
+				pkts = append(pkts, newPacket(data))
+			}
+			e.writePackets(pkts)
+		}
+		<-done
+		reportRate(b)
+	})
+	b.Run("write/perPacket", func(b *testing.B) {
+		fd, peer := socketpair(b)
+		data := benchPacket()
+		b.ResetTimer()
+		done := readPeer(peerFile(b, peer), b.N)
+		for i := 0; i < b.N; i++ {
+			perPacketWrite(fd, newPacket(data))
+		}
+		<-done
+		reportRate(b)
+	})
+}
@@ -0,0 +1,109 @@
+package tun
+
+import (
+	"context"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/stats"
+	dnsproxy "github.com/xtls/xray-core/proxy/dns"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// DNSHijackConfig selects the flows answered by the DNS module instead of
+// being dispatched. Servers lists the hijacked addresses; when it is empty
+// every flow to port 53 is hijacked. NonIPQuery is passed on to the DNS
+// outbound and decides what happens to queries other than A and AAAA.
+type DNSHijackConfig struct {
+	Enabled    bool
+	Servers    []net.Destination
+	NonIPQuery string
+}
+
+type dnsHijack struct {
+	servers []net.Destination
+	handler *dnsproxy.Handler
+	dialer  internet.Dialer
+}
+
+func newDNSHijack(v *core.Instance, cfg *DNSHijackConfig) (*dnsHijack, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	handler, err := core.CreateObject(v, &dnsproxy.Config{
+		Non_IPQuery: cfg.NonIPQuery,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dnsHijack{
+		servers: cfg.Servers,
+		handler: handler.(*dnsproxy.Handler),
+		dialer:  &dispatchDialer{v: v},
+	}, nil
+}
+
+func (h *dnsHijack) match(dst net.Destination) bool {
+	if h == nil {
+		return false
+	}
+	if len(h.servers) == 0 {
+		return dst.Port == 53
+	}
+	for _, server := range h.servers {
+		if server.Port == dst.Port && server.Address.String() == dst.Address.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *dnsHijack) process(ctx context.Context, reader buf.Reader, writer buf.Writer) error {
+	return h.handler.Process(ctx, &transport.Link{
+		Reader: reader,
+		Writer: writer,
+	}, h.dialer)
+}
+
+var _ internet.Dialer = (*dispatchDialer)(nil)
+
+// dispatchDialer dials through the dispatcher of the instance, so that the
+// queries the DNS module passes on still follow the routing rules.
+type dispatchDialer struct {
+	v *core.Instance
+}
+
+func (d *dispatchDialer) Dial(ctx context.Context, dest net.Destination) (stat.Connection, error) {
+	return core.Dial(session.ContextWithOutbounds(ctx, nil), d.v, dest)
+}
+
+func (d *dispatchDialer) DestIpAddress() net.IP {
+	return nil
+}
+
+func (d *dispatchDialer) SetOutboundGateway(ctx context.Context, ob *session.Outbound) {}
+
+type countingReader struct {
+	buf.Reader
+	counter stats.Counter
+}
+
+func (r *countingReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.Reader.ReadMultiBuffer()
+	r.counter.Add(int64(mb.Len()))
+	return mb, err
+}
+
+type countingWriter struct {
+	buf.Writer
+	counter stats.Counter
+}
+
+func (w *countingWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.counter.Add(int64(mb.Len()))
+	return w.Writer.WriteMultiBuffer(mb)
+}
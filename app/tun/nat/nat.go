@@ -0,0 +1,224 @@
+package nat
+
+import (
+	"io"
+	"math"
+	"sync"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/signal/done"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// Backlog is the number of datagrams queued per session before new ones
+// are dropped.
+const Backlog = 256
+
+// Table implements endpoint-independent mapping for UDP: all datagrams sent
+// from one source endpoint of the tun share a Session, whatever their
+// destination, and replies from any remote are delivered back to it.
+type Table struct {
+	stack    *stack.Stack
+	nicID    tcpip.NICID
+	handle   func(*Session)
+	perFlow  bool
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewTable(s *stack.Stack, nicID tcpip.NICID, handle func(*Session)) *Table {
+	return &Table{
+		stack:    s,
+		nicID:    nicID,
+		handle:   handle,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// NewFlowTable returns a Table that keys sessions by source and destination
+// instead, and answers every datagram from the address it was sent to.
+func NewFlowTable(s *stack.Stack, nicID tcpip.NICID, handle func(*Session)) *Table {
+	t := NewTable(s, nicID, handle)
+	t.perFlow = true
+	return t
+}
+
+// HandlePacket is installed as the UDP transport protocol handler of the
+// stack. It queues the datagram on the session of its source, starting a new
+// session if there is none.
+func (t *Table) HandlePacket(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+	hdr := header.UDP(pkt.TransportHeader().Slice())
+	netHdr := pkt.Network()
+	lengthValid, csumValid := header.UDPValid(
+		hdr,
+		func() uint16 { return pkt.Data().Checksum() },
+		uint16(pkt.Data().Size()),
+		pkt.NetworkProtocolNumber,
+		netHdr.SourceAddress(),
+		netHdr.DestinationAddress(),
+		pkt.RXChecksumValidated)
+	if !lengthValid || !csumValid {
+		return true
+	}
+	payload := pkt.Data().AsRange().ToSlice()
+	payload = payload[:int(hdr.Length())-header.UDPMinimumSize]
+
+	src := net.UDPDestination(net.IPAddress(id.RemoteAddress.AsSlice()), net.Port(id.RemotePort))
+	dst := net.UDPDestination(net.IPAddress(id.LocalAddress.AsSlice()), net.Port(id.LocalPort))
+	key := src.NetAddr()
+	if t.perFlow {
+		key += "-" + dst.NetAddr()
+	}
+
+	t.mutex.Lock()
+	s, found := t.sessions[key]
+	if !found {
+		s = &Session{
+			Source:      src,
+			Destination: dst,
+			table:       t,
+			key:         key,
+			packets:     make(chan *buf.Buffer, Backlog),
+			done:        done.New(),
+		}
+		t.sessions[key] = s
+	}
+	t.mutex.Unlock()
+	if !found {
+		go t.handle(s)
+	}
+
+	b := buf.NewWithSize(int32(len(payload)))
+	b.Write(payload)
+	b.UDP = &dst
+	select {
+	case s.packets <- b:
+	default:
+		b.Release()
+	}
+	return true
+}
+
+func (t *Table) remove(s *Session) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.sessions[s.key] == s {
+		delete(t.sessions, s.key)
+	}
+}
+
+// write sends payload into the stack as a datagram from one address to
+// another. The stack must have spoofing enabled on the NIC.
+func (t *Table) write(from, to net.Destination, payload []byte) error {
+	netProto := ipv4.ProtocolNumber
+	if to.Address.Family().IsIPv6() {
+		netProto = ipv6.ProtocolNumber
+	}
+	r, err := t.stack.FindRoute(
+		t.nicID,
+		tcpip.AddrFromSlice(from.Address.IP()),
+		tcpip.AddrFromSlice(to.Address.IP()),
+		netProto,
+		false,
+	)
+	if err != nil {
+		return errors.New("failed to find route: ", err.String())
+	}
+	defer r.Release()
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: header.UDPMinimumSize + int(r.MaxHeaderLength()),
+		Payload:            buffer.MakeWithData(payload),
+	})
+	defer pkt.DecRef()
+
+	hdr := header.UDP(pkt.TransportHeader().Push(header.UDPMinimumSize))
+	pkt.TransportProtocolNumber = udp.ProtocolNumber
+	length := uint16(pkt.Size())
+	hdr.Encode(&header.UDPFields{
+		SrcPort: uint16(from.Port),
+		DstPort: uint16(to.Port),
+		Length:  length,
+	})
+	xsum := hdr.CalculateChecksum(checksum.Combine(
+		r.PseudoHeaderChecksum(udp.ProtocolNumber, length),
+		pkt.Data().Checksum(),
+	))
+	if xsum != math.MaxUint16 {
+		xsum = ^xsum
+	}
+	hdr.SetChecksum(xsum)
+	if err := r.WritePacket(stack.NetworkHeaderParams{
+		Protocol: udp.ProtocolNumber,
+		TTL:      r.DefaultTTL(),
+	}, pkt); err != nil {
+		return errors.New("failed to write packet: ", err.String())
+	}
+	return nil
+}
+
+// Session carries the datagrams of one source endpoint, or of one flow in a
+// table from NewFlowTable. Reads return every datagram with b.UDP set to its
+// destination; writes deliver every buffer to the source, from the address
+// in b.UDP or from Destination if it is unset or the table is per flow.
+type Session struct {
+	Source      net.Destination
+	Destination net.Destination
+
+	table   *Table
+	key     string
+	packets chan *buf.Buffer
+	done    *done.Instance
+}
+
+func (s *Session) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	select {
+	case b := <-s.packets:
+		return buf.MultiBuffer{b}, nil
+	case <-s.done.Wait():
+		return nil, io.EOF
+	}
+}
+
+func (s *Session) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	if s.done.Done() {
+		return io.ErrClosedPipe
+	}
+	for _, b := range mb {
+		from := s.Destination
+		if !s.table.perFlow && b.UDP != nil && b.UDP.Address.Family().IsIP() && b.UDP.Address.Family() == s.Source.Address.Family() {
+			from = *b.UDP
+		}
+		if err := s.table.write(from, s.Source, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) Interrupt() {
+	s.Close()
+}
+
+func (s *Session) Close() error {
+	s.table.remove(s)
+	err := s.done.Close()
+	for {
+		select {
+		case b := <-s.packets:
+			b.Release()
+		default:
+			return err
+		}
+	}
+}
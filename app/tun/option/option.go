@@ -3,7 +3,6 @@ package option
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"github.com/xtls/xray-core/common/errors"
 	"github.com/xtls/xray-core/common/net"
@@ -196,7 +195,7 @@ func WithRouteTable(nicID tcpip.NICID) Option {
 	}
 }
 
-func WithTransportHandler(handle func(src, dst net.Destination, conn net.Conn)) Option {
+func WithTCPHandler(handle func(src, dst net.Destination, conn net.Conn)) Option {
 	return func(s *stack.Stack) error {
 		tcpForwarder := tcp.NewForwarder(s, 0, 65535, func(r *tcp.ForwarderRequest) {
 			go func(r *tcp.ForwarderRequest) {
@@ -221,31 +220,13 @@ func WithTransportHandler(handle func(src, dst net.Destination, conn net.Conn))
 			}(r)
 		})
 		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+		return nil
+	}
+}
 
-		udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
-			go func(r *udp.ForwarderRequest) {
-				var (
-					wq waiter.Queue
-					id = r.ID()
-				)
-				ep, err := r.CreateEndpoint(&wq)
-				if err != nil {
-					errors.LogError(context.Background(), err.String())
-					return
-				}
-				defer ep.Close()
-				ep.SocketOptions().SetLinger(tcpip.LingerOption{
-					Enabled: true,
-					Timeout: 15 * time.Second,
-				})
-				handle(
-					net.UDPDestination(net.IPAddress(id.RemoteAddress.AsSlice()), net.Port(id.RemotePort)),
-					net.UDPDestination(net.IPAddress(id.LocalAddress.AsSlice()), net.Port(id.LocalPort)),
-					gonet.NewUDPConn(&wq, ep),
-				)
-			}(r)
-		})
-		s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+func WithUDPHandler(handle func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool) Option {
+	return func(s *stack.Stack) error {
+		s.SetTransportProtocolHandler(udp.ProtocolNumber, handle)
 		return nil
 	}
 }
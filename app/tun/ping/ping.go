@@ -0,0 +1,182 @@
+package ping
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"vpn/app/ohos"
+
+	"github.com/xtls/xray-core/common/errors"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	Timeout = 5 * time.Second
+	// MaxInflight bounds the pings waiting for a reply; requests beyond it
+	// are dropped.
+	MaxInflight = 64
+
+	ipprotoICMPv6 = 58
+)
+
+// Forwarder answers ICMP echo requests read from the tun by sending a real
+// ping through an unprivileged ICMP datagram socket bound to the default
+// interface, and writes the reply back to the tun.
+type Forwarder struct {
+	write    func([]byte) error
+	inflight chan struct{}
+}
+
+func New(write func([]byte) error) *Forwarder {
+	return &Forwarder{
+		write:    write,
+		inflight: make(chan struct{}, MaxInflight),
+	}
+}
+
+// Handle takes over data if it is an ICMP echo request and reports whether
+// it did so. Other packets are left to the stack. data is not retained.
+func (f *Forwarder) Handle(data []byte) bool {
+	switch header.IPVersion(data) {
+	case header.IPv4Version:
+		ip := header.IPv4(data)
+		if !ip.IsValid(len(data)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return false
+		}
+		msg := header.ICMPv4(ip.Payload())
+		if len(msg) < header.ICMPv4MinimumSize || msg.Type() != header.ICMPv4Echo {
+			return false
+		}
+		src, dst := ip.SourceAddress(), ip.DestinationAddress()
+		msg = append(header.ICMPv4(nil), msg...)
+		f.spawn(func() {
+			f.echo4(src, dst, msg)
+		})
+		return true
+	case header.IPv6Version:
+		ip := header.IPv6(data)
+		if !ip.IsValid(len(data)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return false
+		}
+		msg := header.ICMPv6(ip.Payload())
+		if len(msg) < header.ICMPv6MinimumSize || msg.Type() != header.ICMPv6EchoRequest {
+			return false
+		}
+		src, dst := ip.SourceAddress(), ip.DestinationAddress()
+		msg = append(header.ICMPv6(nil), msg...)
+		f.spawn(func() {
+			f.echo6(src, dst, msg)
+		})
+		return true
+	}
+	return false
+}
+
+func (f *Forwarder) spawn(fn func()) {
+	select {
+	case f.inflight <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-f.inflight }()
+		fn()
+	}()
+}
+
+func (f *Forwarder) echo4(src, dst tcpip.Address, req header.ICMPv4) {
+	data, err := exchange(syscall.AF_INET, syscall.IPPROTO_ICMP, &syscall.SockaddrInet4{Addr: dst.As4()}, req)
+	if err != nil {
+		errors.LogDebugInner(context.Background(), err, "ping ", dst, " failed")
+		return
+	}
+	rsp := header.ICMPv4(data)
+	if len(rsp) < header.ICMPv4MinimumSize || rsp.Type() != header.ICMPv4EchoReply {
+		return
+	}
+	pkt := make([]byte, header.IPv4MinimumSize+len(rsp))
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     dst,
+		DstAddr:     src,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	msg := header.ICMPv4(ip.Payload())
+	copy(msg, rsp)
+	msg.SetIdent(req.Ident())
+	msg.SetSequence(req.Sequence())
+	msg.SetChecksum(0)
+	msg.SetChecksum(header.ICMPv4Checksum(msg, 0))
+	if err := f.write(pkt); err != nil {
+		errors.LogDebugInner(context.Background(), err, "failed to write ping reply")
+	}
+}
+
+func (f *Forwarder) echo6(src, dst tcpip.Address, req header.ICMPv6) {
+	data, err := exchange(syscall.AF_INET6, ipprotoICMPv6, &syscall.SockaddrInet6{Addr: dst.As16()}, req)
+	if err != nil {
+		errors.LogDebugInner(context.Background(), err, "ping ", dst, " failed")
+		return
+	}
+	rsp := header.ICMPv6(data)
+	if len(rsp) < header.ICMPv6MinimumSize || rsp.Type() != header.ICMPv6EchoReply {
+		return
+	}
+	pkt := make([]byte, header.IPv6MinimumSize+len(rsp))
+	ip := header.IPv6(pkt)
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(rsp)),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           dst,
+		DstAddr:           src,
+	})
+	msg := header.ICMPv6(ip.Payload())
+	copy(msg, rsp)
+	msg.SetIdent(req.Ident())
+	msg.SetSequence(req.Sequence())
+	msg.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: msg,
+		Src:    dst,
+		Dst:    src,
+	}))
+	if err := f.write(pkt); err != nil {
+		errors.LogDebugInner(context.Background(), err, "failed to write ping reply")
+	}
+}
+
+// exchange sends req over a fresh ICMP datagram socket and returns the first
+// echo reply. The kernel owns the identifier of such sockets, so the caller
+// restores the original one.
+func exchange(family, proto int, addr syscall.Sockaddr, req []byte) ([]byte, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	device, err := ohos.DefaultNetInterfaceName()
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.BindToDevice(fd, device); err != nil {
+		return nil, err
+	}
+	tv := syscall.NsecToTimeval(int64(Timeout))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return nil, err
+	}
+	if err := syscall.Sendto(fd, req, 0, addr); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 65535)
+	n, _, err := syscall.Recvfrom(fd, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
@@ -0,0 +1,118 @@
+package tun
+
+import (
+	"fmt"
+
+	"vpn/app/tun/option"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// TCP loss recovery modes.
+const (
+	RecoveryNone = "none"
+	RecoveryRACK = "rack"
+)
+
+type BufferSizeRange struct {
+	Min     int
+	Default int
+	Max     int
+}
+
+// StackConfig tunes the gVisor stack. See DefaultStackConfig for the values
+// used when nothing is configured.
+type StackConfig struct {
+	TTL                      uint8
+	ICMPBurst                int
+	ICMPLimit                float64
+	TCPSendBufferSize        BufferSizeRange
+	TCPReceiveBufferSize     BufferSizeRange
+	TCPCongestionControl     string
+	TCPDelay                 bool
+	TCPModerateReceiveBuffer bool
+	TCPSACK                  bool
+	TCPRecovery              string
+}
+
+func DefaultStackConfig() StackConfig {
+	return StackConfig{
+		TTL:       64,
+		ICMPBurst: 50,
+		ICMPLimit: 1000,
+		TCPSendBufferSize: BufferSizeRange{
+			Min:     tcp.MinBufferSize,
+			Default: tcp.DefaultSendBufferSize,
+			Max:     tcp.MaxBufferSize,
+		},
+		TCPReceiveBufferSize: BufferSizeRange{
+			Min:     tcp.MinBufferSize,
+			Default: tcp.DefaultReceiveBufferSize,
+			Max:     tcp.MaxBufferSize,
+		},
+		TCPCongestionControl:     "cubic",
+		TCPDelay:                 false,
+		TCPModerateReceiveBuffer: false,
+		TCPSACK:                  true,
+		TCPRecovery:              RecoveryRACK,
+	}
+}
+
+func (c *StackConfig) Validate() error {
+	if c.TTL == 0 {
+		return fmt.Errorf("stack: ttl must be between 1 and 255")
+	}
+	if c.ICMPBurst <= 0 {
+		return fmt.Errorf("stack: icmp burst must be positive: %d", c.ICMPBurst)
+	}
+	if c.ICMPLimit <= 0 {
+		return fmt.Errorf("stack: icmp limit must be positive: %v", c.ICMPLimit)
+	}
+	if err := c.TCPSendBufferSize.validate(); err != nil {
+		return fmt.Errorf("stack: tcp send buffer size: %v", err)
+	}
+	if err := c.TCPReceiveBufferSize.validate(); err != nil {
+		return fmt.Errorf("stack: tcp receive buffer size: %v", err)
+	}
+	switch c.TCPCongestionControl {
+	case "cubic", "reno":
+	default:
+		return fmt.Errorf("stack: unknown congestion control: %s", c.TCPCongestionControl)
+	}
+	switch c.TCPRecovery {
+	case RecoveryNone, RecoveryRACK:
+	default:
+		return fmt.Errorf("stack: unknown tcp recovery: %s", c.TCPRecovery)
+	}
+	return nil
+}
+
+func (r *BufferSizeRange) validate() error {
+	if r.Min <= 0 || r.Min > r.Default || r.Default > r.Max {
+		return fmt.Errorf("invalid range: %d %d %d", r.Min, r.Default, r.Max)
+	}
+	return nil
+}
+
+// options returns the options applying c. They may be applied to a running
+// stack as well.
+func (c *StackConfig) options() []option.Option {
+	recovery := tcpip.TCPRecovery(0)
+	if c.TCPRecovery == RecoveryRACK {
+		recovery = tcpip.TCPRACKLossDetection
+	}
+	return []option.Option{
+		option.WithDefaultTTL(c.TTL),
+		option.WithICMPBurst(c.ICMPBurst),
+		option.WithICMPLimit(rate.Limit(c.ICMPLimit)),
+		option.WithTCPSendBufferSizeRange(c.TCPSendBufferSize.Min, c.TCPSendBufferSize.Default, c.TCPSendBufferSize.Max),
+		option.WithTCPReceiveBufferSizeRange(c.TCPReceiveBufferSize.Min, c.TCPReceiveBufferSize.Default, c.TCPReceiveBufferSize.Max),
+		option.WithTCPCongestionControl(c.TCPCongestionControl),
+		option.WithTCPDelay(c.TCPDelay),
+		option.WithTCPModerateReceiveBuffer(c.TCPModerateReceiveBuffer),
+		option.WithTCPSACKEnabled(c.TCPSACK),
+		option.WithTCPRecovery(recovery),
+	}
+}
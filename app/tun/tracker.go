@@ -0,0 +1,146 @@
+package tun
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+)
+
+// Flow is a snapshot of a live connection proxied from the tun.
+type Flow struct {
+	ID          uint64    `json:"id"`
+	Network     string    `json:"network"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Domain      string    `json:"domain,omitempty"`
+	Protocol    string    `json:"protocol,omitempty"`
+	Outbound    string    `json:"outbound,omitempty"`
+	Start       time.Time `json:"start"`
+	Uplink      int64     `json:"uplink"`
+	Downlink    int64     `json:"downlink"`
+}
+
+type flow struct {
+	id       uint64
+	src      net.Destination
+	dst      net.Destination
+	start    time.Time
+	uplink   *Counter
+	downlink *Counter
+	cancel   context.CancelFunc
+
+	// Routing results, set by Tracker.route and guarded by Tracker.mutex.
+	domain   string
+	protocol string
+	outbound string
+}
+
+// Tracker records the flows that are being proxied and allows closing them.
+type Tracker struct {
+	mutex  sync.Mutex
+	nextID uint64
+	flows  map[uint64]*flow
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		flows: make(map[uint64]*flow),
+	}
+}
+
+func (t *Tracker) add(f *flow) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.nextID++
+	f.id = t.nextID
+	t.flows[f.id] = f
+}
+
+func (t *Tracker) remove(f *flow) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.flows, f.id)
+}
+
+// List returns the live flows ordered by ID.
+func (t *Tracker) List() []Flow {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	flows := make([]Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, f.snapshot())
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].ID < flows[j].ID
+	})
+	return flows
+}
+
+// Close terminates the flow with the given id. It reports whether the flow
+// was found.
+func (t *Tracker) Close(id uint64) bool {
+	t.mutex.Lock()
+	f, ok := t.flows[id]
+	t.mutex.Unlock()
+	if ok {
+		f.cancel()
+	}
+	return ok
+}
+
+// route records the routing results of f. The dispatcher fills ob and
+// content from its own goroutines, so route must only be called once those
+// writes are known to have happened, such as after the first read from the
+// outbound link.
+func (t *Tracker) route(f *flow, ob *session.Outbound, content *session.Content) {
+	target := ob.RouteTarget
+	if !target.IsValid() {
+		target = ob.Target
+	}
+	var domain string
+	if target.IsValid() && target.Address.Family().IsDomain() {
+		domain = target.Address.Domain()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f.domain = domain
+	f.protocol = content.Protocol
+	f.outbound = ob.Tag
+}
+
+func (f *flow) snapshot() Flow {
+	return Flow{
+		ID:          f.id,
+		Network:     f.dst.Network.SystemString(),
+		Source:      f.src.NetAddr(),
+		Destination: f.dst.NetAddr(),
+		Domain:      f.domain,
+		Protocol:    f.protocol,
+		Outbound:    f.outbound,
+		Start:       f.start,
+		Uplink:      f.uplink.Value(),
+		Downlink:    f.downlink.Value(),
+	}
+}
+
+// routedReader calls routed once the outbound side has sent data or closed
+// the link. Interrupts may come from our side and are not waited for.
+type routedReader struct {
+	buf.Reader
+	routed func()
+	once   sync.Once
+}
+
+func (r *routedReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.Reader.ReadMultiBuffer()
+	if !mb.IsEmpty() || err == io.EOF {
+		r.once.Do(r.routed)
+	}
+	return mb, err
+}
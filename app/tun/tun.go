@@ -2,9 +2,15 @@ package tun
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
+	"vpn/app/tun/capture"
 	"vpn/app/tun/endpoint"
+	"vpn/app/tun/nat"
 	"vpn/app/tun/option"
+	"vpn/app/tun/ping"
 
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
@@ -18,6 +24,7 @@ import (
 	"github.com/xtls/xray-core/features"
 	"github.com/xtls/xray-core/features/policy"
 	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/features/stats"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
@@ -28,11 +35,24 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
+// ICMP echo handling modes. With ICMPLocal the stack answers every ping
+// itself, with ICMPForward pings are sent to the real destination.
+const (
+	ICMPLocal   = "local"
+	ICMPForward = "forward"
+)
+
+const nicID tcpip.NICID = 1
+
 type Config struct {
-	Tag      string
-	Fd       int
-	MTU      int
-	Sniffing session.SniffingRequest
+	Tag       string
+	Fd        int
+	MTU       int
+	CloseFd   bool
+	ICMP      string
+	Sniffing  session.SniffingRequest
+	DNSHijack DNSHijackConfig
+	Stack     StackConfig
 }
 
 func init() {
@@ -44,28 +64,60 @@ func init() {
 type Tun struct {
 	ctx           context.Context
 	stack         *stack.Stack
+	ep            *endpoint.Endpoint
 	fd            int
 	mtu           int
+	closeFd       bool
+	icmp          string
 	dispatcher    routing.Dispatcher
 	policyManager policy.Manager
+	uplink        stats.Counter
+	downlink      stats.Counter
+	sniffing      session.SniffingRequest
+	tracker       *Tracker
+	hijack        *dnsHijack
+	stackConfig   StackConfig
+
+	captureMutex sync.Mutex
+	capture      *capture.Writer
 }
 
 var _ features.Feature = (*Tun)(nil)
 
 func New(ctx context.Context, cfg *Config) (*Tun, error) {
+	switch cfg.ICMP {
+	case "":
+		cfg.ICMP = ICMPLocal
+	case ICMPLocal, ICMPForward:
+	default:
+		return nil, fmt.Errorf("unknown icmp mode: %s", cfg.ICMP)
+	}
+	if err := cfg.Stack.Validate(); err != nil {
+		return nil, err
+	}
 	v := core.MustFromContext(ctx)
 	ctx = session.ContextWithInbound(ctx, &session.Inbound{
 		Tag: cfg.Tag,
 	})
-	ctx = session.ContextWithContent(ctx, &session.Content{
-		SniffingRequest: cfg.Sniffing,
-	})
+	hijack, err := newDNSHijack(v, &cfg.DNSHijack)
+	if err != nil {
+		return nil, err
+	}
+	uplink, downlink := inboundCounters(v, cfg.Tag)
 	return &Tun{
 		ctx:           ctx,
 		fd:            cfg.Fd,
 		mtu:           cfg.MTU,
+		closeFd:       cfg.CloseFd,
+		icmp:          cfg.ICMP,
 		dispatcher:    v.GetFeature(routing.DispatcherType()).(routing.Dispatcher),
 		policyManager: v.GetFeature(policy.ManagerType()).(policy.Manager),
+		uplink:        uplink,
+		downlink:      downlink,
+		sniffing:      cfg.Sniffing,
+		tracker:       NewTracker(),
+		hijack:        hijack,
+		stackConfig:   cfg.Stack,
 	}, nil
 }
 
@@ -73,8 +125,29 @@ func (t *Tun) Type() any {
 	return (*Tun)(nil)
 }
 
+// StartError reports that Start failed to bring up the tun device.
+type StartError struct {
+	Err error
+}
+
+func (e *StartError) Error() string {
+	return "failed to start tun: " + e.Err.Error()
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
 func (t *Tun) Start() error {
-	ep := endpoint.New(t.fd, t.mtu)
+	if t.stack != nil {
+		return nil
+	}
+	ep, err := endpoint.New(t.fd, t.mtu, t.closeFd)
+	if err != nil {
+		return &StartError{Err: err}
+	}
+	t.ep = ep
+	t.ep.Intercept(t.interceptor())
 	t.stack = stack.New(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocolFactory{
 			ipv4.NewProtocol,
@@ -87,34 +160,171 @@ func (t *Tun) Start() error {
 			icmp.NewProtocol6,
 		},
 	})
-	var nicID tcpip.NICID = 1
-	opts := []option.Option{
-		option.WithDefaultTTL(64),
+	opts := append(t.stackConfig.options(),
 		option.WithForwarding(true),
-		option.WithICMPBurst(50),
-		option.WithICMPLimit(1000),
-		option.WithTCPSendBufferSizeRange(tcp.MinBufferSize, tcp.DefaultSendBufferSize, tcp.MaxBufferSize),
-		option.WithTCPReceiveBufferSizeRange(tcp.MinBufferSize, tcp.DefaultReceiveBufferSize, tcp.MaxBufferSize),
-		option.WithTCPCongestionControl("cubic"),
-		option.WithTCPDelay(false),
-		option.WithTCPModerateReceiveBuffer(false),
-		option.WithTCPSACKEnabled(true),
-		option.WithTCPRecovery(tcpip.TCPRACKLossDetection),
-		option.WithCreatingNIC(nicID, ep),
+		option.WithCreatingNIC(nicID, t.ep),
 		option.WithPromiscuousMode(nicID, true),
 		option.WithSpoofing(nicID, true),
 		option.WithRouteTable(nicID),
-		option.WithTransportHandler(t.handle),
+		option.WithTCPHandler(t.handle),
+		option.WithUDPHandler(t.udpHandler()),
+	)
+	for _, opt := range opts {
+		if err := opt(t.stack); err != nil {
+			return &StartError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Adopt moves the running stack, endpoint, flow tracker and capture of prev
+// over to t, so that t.Start leaves them running and the fd stays open. New
+// flows are still handled by prev until Switch is called, and prev.Adopt(t)
+// hands everything back before that. prev is left without a stack.
+func (t *Tun) Adopt(prev *Tun) error {
+	if prev.stack == nil {
+		return nil
 	}
+	if prev.fd != t.fd || prev.mtu != t.mtu || prev.closeFd != t.closeFd {
+		return fmt.Errorf("tun fd, mtu or closeFd changed, restart required")
+	}
+	prev.captureMutex.Lock()
+	t.capture, prev.capture = prev.capture, nil
+	prev.captureMutex.Unlock()
+	t.stack, t.ep, t.tracker = prev.stack, prev.ep, prev.tracker
+	prev.stack, prev.ep = nil, nil
+	return nil
+}
+
+// Switch applies t's stack tuning to an adopted stack and makes t handle
+// new flows. Flows already in progress are not moved. They keep the links
+// the previous instance dispatched them to, so they only outlive that
+// instance as far as its outbound connections do.
+func (t *Tun) Switch() error {
+	opts := append(t.stackConfig.options(),
+		option.WithTCPHandler(t.handle),
+		option.WithUDPHandler(t.udpHandler()),
+	)
 	for _, opt := range opts {
 		if err := opt(t.stack); err != nil {
 			return err
 		}
 	}
+	t.ep.Intercept(t.interceptor())
+	return nil
+}
+
+// udpHandler hands datagrams to a fresh NAT table, except those to hijacked
+// DNS servers. These are picked out one by one before the NAT lookup, so a
+// source that also talks to other remotes still has its queries answered,
+// and go to a table of their own with a session per flow.
+func (t *Tun) udpHandler() func(stack.TransportEndpointID, *stack.PacketBuffer) bool {
+	table := nat.NewTable(t.stack, nicID, t.handleSession)
+	if t.hijack == nil {
+		return table.HandlePacket
+	}
+	hijacked := nat.NewFlowTable(t.stack, nicID, t.handleSession)
+	return func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		dst := net.UDPDestination(net.IPAddress(id.LocalAddress.AsSlice()), net.Port(id.LocalPort))
+		if t.hijack.match(dst) {
+			return hijacked.HandlePacket(id, pkt)
+		}
+		return table.HandlePacket(id, pkt)
+	}
+}
+
+func (t *Tun) interceptor() func([]byte) bool {
+	if t.icmp != ICMPForward {
+		return nil
+	}
+	return ping.New(t.ep.WriteRaw).Handle
+}
+
+// Flows lists the connections currently proxied from the tun.
+func (t *Tun) Flows() []Flow {
+	return t.tracker.List()
+}
+
+// CloseFlow terminates the flow with the given id.
+func (t *Tun) CloseFlow(id uint64) bool {
+	return t.tracker.Close(id)
+}
+
+// CaptureStats describes a packet capture.
+type CaptureStats struct {
+	Path    string `json:"path"`
+	Packets int    `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+	Done    bool   `json:"done"`
+}
+
+// StartCapture records packets crossing the tun fd to a pcap file, replacing
+// any capture already running.
+func (t *Tun) StartCapture(cfg capture.Config) error {
+	t.captureMutex.Lock()
+	defer t.captureMutex.Unlock()
+	if t.ep == nil {
+		return fmt.Errorf("tun is not running")
+	}
+	w, err := capture.New(cfg)
+	if err != nil {
+		return err
+	}
+	if t.capture != nil {
+		t.ep.Tap(nil)
+		t.capture.Close()
+	}
+	t.capture = w
+	t.ep.Tap(w.WritePacket)
 	return nil
 }
 
+// StopCapture ends the running capture and returns its final stats.
+func (t *Tun) StopCapture() (CaptureStats, error) {
+	t.captureMutex.Lock()
+	defer t.captureMutex.Unlock()
+	if t.capture == nil {
+		return CaptureStats{}, fmt.Errorf("no capture running")
+	}
+	if t.ep != nil {
+		t.ep.Tap(nil)
+	}
+	err := t.capture.Close()
+	stats := captureStats(t.capture)
+	t.capture = nil
+	return stats, err
+}
+
+// Capture returns the stats of the running capture, if any.
+func (t *Tun) Capture() (CaptureStats, bool) {
+	t.captureMutex.Lock()
+	defer t.captureMutex.Unlock()
+	if t.capture == nil {
+		return CaptureStats{}, false
+	}
+	return captureStats(t.capture), true
+}
+
+func captureStats(w *capture.Writer) CaptureStats {
+	packets, bytes, done := w.Stats()
+	return CaptureStats{
+		Path:    w.Path(),
+		Packets: packets,
+		Bytes:   bytes,
+		Done:    done,
+	}
+}
+
 func (t *Tun) Close() error {
+	t.captureMutex.Lock()
+	if t.capture != nil {
+		t.capture.Close()
+		t.capture = nil
+	}
+	t.captureMutex.Unlock()
+	if t.ep != nil {
+		t.ep.Close()
+	}
 	if t.stack != nil {
 		t.stack.Close()
 	}
@@ -123,7 +333,31 @@ func (t *Tun) Close() error {
 
 func (t *Tun) handle(src, dst net.Destination, conn net.Conn) {
 	defer conn.Close()
+	t.proxy(src, dst, buf.NewReader(conn), buf.NewWriter(conn))
+}
+
+func (t *Tun) handleSession(s *nat.Session) {
+	defer s.Close()
+	t.proxy(s.Source, s.Destination, s, s)
+}
+
+func (t *Tun) proxy(src, dst net.Destination, reader buf.Reader, writer buf.Writer) {
 	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+	ob := &session.Outbound{}
+	content := &session.Content{SniffingRequest: t.sniffing}
+	f := &flow{
+		src:      src,
+		dst:      dst,
+		start:    time.Now(),
+		uplink:   NewCounter(t.uplink),
+		downlink: NewCounter(t.downlink),
+		cancel:   cancel,
+	}
+	t.tracker.add(f)
+	defer t.tracker.remove(f)
+	ctx = session.ContextWithOutbounds(ctx, []*session.Outbound{ob})
+	ctx = session.ContextWithContent(ctx, content)
 	plcy := t.policyManager.ForLevel(0)
 	timer := signal.CancelAfterInactivity(ctx, cancel, plcy.Timeouts.ConnectionIdle)
 	ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
@@ -132,21 +366,38 @@ func (t *Tun) handle(src, dst net.Destination, conn net.Conn) {
 		Status: log.AccessAccepted,
 		Reason: "",
 	})
+	if t.hijack.match(dst) {
+		ob.Target = dst
+		ob.Tag = "dns-hijack"
+		t.tracker.route(f, ob, content)
+		reader = &countingReader{Reader: reader, counter: f.uplink}
+		writer = &countingWriter{Writer: writer, counter: f.downlink}
+		if err := t.hijack.process(ctx, reader, writer); err != nil {
+			errors.LogDebugInner(t.ctx, err, "dns hijack ends")
+		}
+		return
+	}
 	link, err := t.dispatcher.Dispatch(ctx, dst)
 	if err != nil {
 		errors.LogErrorInner(t.ctx, err, "dispatch connection")
+		return
 	}
-	defer cancel()
 	reqDone := func() error {
 		defer timer.SetTimeout(plcy.Timeouts.DownlinkOnly)
-		if err := buf.Copy(buf.NewReader(conn), link.Writer, buf.UpdateActivity(timer)); err != nil {
+		if err := buf.Copy(reader, link.Writer, buf.UpdateActivity(timer), buf.AddToStatCounter(f.uplink)); err != nil {
 			return errors.New("failed to transport all request").Base(err)
 		}
 		return nil
 	}
+	// The dispatcher routes the flow on its own goroutines. Anything read
+	// back from the outbound handler happens after routing has finished.
+	routed := &routedReader{
+		Reader: link.Reader,
+		routed: func() { t.tracker.route(f, ob, content) },
+	}
 	rspDone := func() error {
 		defer timer.SetTimeout(plcy.Timeouts.UplinkOnly)
-		if err := buf.Copy(link.Reader, buf.NewWriter(conn), buf.UpdateActivity(timer)); err != nil {
+		if err := buf.Copy(routed, writer, buf.UpdateActivity(timer), buf.AddToStatCounter(f.downlink)); err != nil {
 			return errors.New("failed to transport all response").Base(err)
 		}
 		return nil
@@ -9,10 +9,13 @@ import "C"
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"unsafe"
 
 	"vpn/app"
 	"vpn/app/ohos"
+
+	commonLog "github.com/xtls/xray-core/common/log"
 )
 
 func main() {
@@ -21,18 +24,115 @@ func main() {
 //export Run
 func Run(config []byte) int32 {
 	if err := app.Run(config); err != nil {
-		ohos.MustGetPlatformSupport().Log(fmt.Sprintf("Run Error: %v", err))
-		return 500
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("Run Error: %v", err))
+		return app.Code(err)
+	}
+	return 0
+}
+
+//export Reload
+func Reload(config []byte) int32 {
+	if err := app.Reload(config); err != nil {
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("Reload Error: %v", err))
+		return app.Code(err)
+	}
+	return 0
+}
+
+//export Stop
+func Stop() int32 {
+	if err := app.Stop(); err != nil {
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("Stop Error: %v", err))
+		return app.Code(err)
+	}
+	return 0
+}
+
+// Create registers an instance built from config and returns its id, or
+// the negated error code on failure.
+//
+//export Create
+func Create(config []byte) int64 {
+	id, err := app.Create(config)
+	if err != nil {
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("Create Error: %v", err))
+		return -int64(app.Code(err))
+	}
+	return id
+}
+
+//export StartInstance
+func StartInstance(id int64) int32 {
+	if err := app.StartInstance(id); err != nil {
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("StartInstance Error: %v", err))
+		return app.Code(err)
+	}
+	return 0
+}
+
+//export StopInstance
+func StopInstance(id int64) int32 {
+	if err := app.StopInstance(id); err != nil {
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("StopInstance Error: %v", err))
+		return app.Code(err)
 	}
 	return 0
 }
 
+//export Destroy
+func Destroy(id int64) int32 {
+	if err := app.Destroy(id); err != nil {
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("Destroy Error: %v", err))
+		return app.Code(err)
+	}
+	return 0
+}
+
+//export NotifyNetworkChanged
+func NotifyNetworkChanged(ifname string) int32 {
+	// ifname points into C memory and is kept beyond this call.
+	if err := app.NotifyNetworkChanged(strings.Clone(ifname)); err != nil {
+		ohos.MustGetPlatformSupport().Log(commonLog.Severity_Error, fmt.Sprintf("NotifyNetworkChanged Error: %v", err))
+		return app.Code(err)
+	}
+	return 0
+}
+
+// LastError returns the message of the error of the last Run, Reload, Stop
+// or instance call, or NULL if it succeeded. The caller frees it with free().
+//
+//export LastError
+func LastError() *C.char {
+	err := app.LastError()
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
 type OHOSSupport struct{}
 
-func (s *OHOSSupport) Log(message string) error {
+// HiLog levels, see LogLevel in hilog/log.h.
+const (
+	hilogDebug = 3
+	hilogInfo  = 4
+	hilogWarn  = 5
+	hilogError = 6
+)
+
+func (s *OHOSSupport) Log(severity commonLog.Severity, message string) error {
+	level := hilogInfo
+	switch severity {
+	case commonLog.Severity_Debug:
+		level = hilogDebug
+	case commonLog.Severity_Warning:
+		level = hilogWarn
+	case commonLog.Severity_Error:
+		level = hilogError
+	}
 	msg := C.CString(message)
 	defer C.free(unsafe.Pointer(msg))
-	C.OHOS_LOG(3, msg)
+	C.OHOS_LOG(C.size_t(level), msg)
 	return nil
 }
 